@@ -1,12 +1,20 @@
 package main
 
 import (
+	"flag"
 	"github.com/mrinalirao/job-worker/server"
 	"log"
 )
 
 func main() {
-	if err := server.RunServer(); err != nil {
+	configPath := flag.String("config", "", "path to the JSON server config file")
+	flag.Parse()
+
+	cfg, err := server.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config, %v", err)
+	}
+	if err := server.RunServer(cfg); err != nil {
 		log.Fatalf("failed to start server, %v", err)
 	}
 }
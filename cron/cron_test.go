@@ -0,0 +1,38 @@
+package cron
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParse_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "* * * foo *"} {
+		_, err := Parse(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestSchedule_Next(t *testing.T) {
+	from := time.Date(2022, time.March, 15, 10, 30, 20, 0, time.UTC)
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2022, time.March, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2022, time.March, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17 * * mon-fri", time.Date(2022, time.March, 15, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2022, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * 7", time.Date(2022, time.March, 20, 2, 30, 0, 0, time.UTC)},
+		// a restricted day of month or day of week matches either of them
+		{"0 0 1 * 5", time.Date(2022, time.March, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		assert.NoError(t, err, tt.expr)
+		assert.Equal(t, tt.next, s.Next(from), tt.expr)
+	}
+}
@@ -2,40 +2,307 @@ package server
 
 import (
 	"context"
+	"errors"
 	"github.com/mrinalirao/job-worker/proto"
+	"github.com/mrinalirao/job-worker/store"
 	"github.com/mrinalirao/job-worker/worker"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	gproto "google.golang.org/protobuf/proto"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func (s *Server) StartJob(ctx context.Context, r *proto.StartJobRequest) (*proto.StartJobResponse, error) {
-	logFields := logrus.Fields{
-		"Action": "StartJob",
-	}
-	log := logrus.WithFields(logFields)
 	user, ok := UserFromContext(ctx)
 	if !ok || user.Name == "" {
 		return nil, status.Errorf(codes.Internal, "failed to verify user")
 	}
+	var jobID string
+	var err error
+	if key := r.GetIdempotencyKey(); key != "" {
+		jobID, err = s.IdempotencyKeys.Start(user.Name, key, r, func() (string, error) {
+			return s.startJob(user, r, "")
+		})
+		if errors.Is(err, ErrIdempotencyKeyReused) {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	} else {
+		jobID, err = s.startJob(user, r, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := proto.StartJobResponse{
+		ID: jobID,
+	}
+	return &res, nil
+}
 
-	jobID, err := s.Worker.Start(r.Cmd, r.Args)
+// jobSpecFromRequest validates the StartJob request of the user and returns the spec of the job
+func (s *Server) jobSpecFromRequest(user *User, r *proto.StartJobRequest) (worker.JobSpec, error) {
+	if r.Group != "" && !contains(r.Group, user.Groups) {
+		return worker.JobSpec{}, status.Errorf(codes.PermissionDenied, "user is not a member of group: %v", r.Group)
+	}
+	if r.Name != "" {
+		if err := validateJobName(r.Name); err != nil {
+			return worker.JobSpec{}, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+	if err := validateLabels(r.Labels); err != nil {
+		return worker.JobSpec{}, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if err := validateEnv(r.Env); err != nil {
+		return worker.JobSpec{}, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if r.InheritEnv && !s.Config.Exec.allowsInheritEnv(user.Roles) {
+		return worker.JobSpec{}, status.Errorf(codes.PermissionDenied, "user is not allowed to inherit the server environment")
+	}
+	if r.Tty && (len(r.Stdin) > 0 || r.OpenStdin) {
+		return worker.JobSpec{}, status.Errorf(codes.InvalidArgument, "tty cannot be used with stdin or open_stdin")
+	}
+	credential, err := s.Config.Exec.RunAs.credentialFor(user)
+	if err != nil {
+		return worker.JobSpec{}, status.Errorf(codes.PermissionDenied, "%v", err)
+	}
+	workingDir := r.WorkingDir
+	if workingDir != "" {
+		if workingDir, err = s.Config.Exec.checkWorkingDir(workingDir); err != nil {
+			return worker.JobSpec{}, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+
+	spec := worker.JobSpec{
+		Cmd:  r.Cmd,
+		Args: r.Args,
+		Limits: worker.Limits{
+			CPUMillis:   r.CpuMillis,
+			MemoryBytes: r.MemoryBytes,
+		},
+		Env:              r.Env,
+		InheritEnv:       r.InheritEnv,
+		WorkingDir:       workingDir,
+		Credential:       credential,
+		Stdin:            r.Stdin,
+		OpenStdin:        r.OpenStdin,
+		TTY:              r.Tty,
+		Name:             r.Name,
+		Labels:           r.Labels,
+		Owner:            user.Name,
+		Priority:         capPriority(s.Config.MaxPriority, s.Config.MinPriority, user.Roles, int(r.Priority)),
+		Preemptible:      r.Preemptible,
+		RequeueOnPreempt: r.RequeueOnPreempt,
+		Timeout:          time.Duration(r.TimeoutSeconds) * time.Second,
+		Retry:            retryPolicyFromRequest(r.GetRetry()),
+		Restart:          restartPolicyFromRequest(r.GetRestart()),
+	}
+	switch spec.Restart.Policy {
+	case worker.RestartNever, worker.RestartOnFailure, worker.RestartAlways:
+	default:
+		return worker.JobSpec{}, status.Errorf(codes.InvalidArgument, "unknown restart policy: %v", spec.Restart.Policy)
+	}
+	switch {
+	case r.StartAt != 0 && r.StartAfterSeconds != 0:
+		return worker.JobSpec{}, status.Errorf(codes.InvalidArgument, "start_at and start_after_seconds cannot be both set")
+	case r.StartAfterSeconds < 0:
+		return worker.JobSpec{}, status.Errorf(codes.InvalidArgument, "start_after_seconds must not be negative")
+	case r.StartAt != 0:
+		spec.StartAt = time.Unix(r.StartAt, 0)
+	case r.StartAfterSeconds != 0:
+		spec.StartAt = time.Now().Add(time.Duration(r.StartAfterSeconds) * time.Second)
+	}
+	return spec, nil
+}
+
+// startJob starts the job of the request as the user, it returns gRPC status errors.
+// The job gets a random ID unless jobID is set. A job with a start time in the future is persisted until it starts.
+func (s *Server) startJob(user *User, r *proto.StartJobRequest, jobID string) (string, error) {
+	log := logrus.WithFields(logrus.Fields{
+		"Action": "StartJob",
+		"UserID": user.Name,
+	})
+	spec, err := s.jobSpecFromRequest(user, r)
+	if err != nil {
+		return "", err
+	}
+	spec.ID = jobID
+	jobID, err = s.Quotas.Reserve(user, spec.Limits, func() (string, error) {
+		return s.Worker.Start(spec)
+	})
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		log.WithError(err).Info("job rejected by quota")
+		return "", status.Errorf(codes.ResourceExhausted, "%v", quotaErr)
+	}
+	if errors.Is(err, worker.ErrInsufficientCapacity) {
+		log.WithError(err).Info("job rejected by admission control")
+		return "", status.Errorf(codes.ResourceExhausted, "job limits do not fit in the host capacity")
+	}
+	if errors.Is(err, worker.ErrNameInUse) {
+		return "", status.Errorf(codes.AlreadyExists, "%v", err)
+	}
 	if err != nil {
 		log.WithError(err).Error("failed to start job")
 		//Note: we intentionally do not expose the errors to the user as the errors might contain internal implementation details.
 		// eg: Unable to remove file, in a prod system we will use different Error types rather than passing error strings and map them to error codes in gRPC.
-		return nil, status.Errorf(codes.Internal, "failed to start job")
+		return "", status.Errorf(codes.Internal, "failed to start job")
 	}
 
-	if err := s.UserJobStore.SetJobUser(jobID, user.Name); err != nil {
+	if err := s.UserJobStore.SetJobOwner(jobID, store.Owner{User: user.Name, Group: r.Group}); err != nil {
 		log.WithError(err).Error("failed to start job")
-		return nil, status.Errorf(codes.Internal, "failed to save job for user")
+		return "", status.Errorf(codes.Internal, "failed to save job for user")
+	}
+	if spec.Name != "" {
+		s.UserJobStore.SetJobName(user.Name, spec.Name, jobID)
 	}
+	if spec.StartAt.After(time.Now()) {
+		if err := s.persistDelayedJob(user, r, jobID, spec.StartAt); err != nil {
+			// the job still starts at its start time unless the server restarts before
+			log.WithError(err).Error("failed to persist delayed job")
+		}
+	}
+	return jobID, nil
+}
 
-	res := proto.StartJobResponse{
-		ID: jobID,
+func (s *Server) persistDelayedJob(user *User, r *proto.StartJobRequest, jobID string, startAt time.Time) error {
+	data, err := protojson.Marshal(r)
+	if err != nil {
+		return err
 	}
-	return &res, nil
+	return s.DelayedJobs.Add(DelayedJob{
+		JobID:   jobID,
+		Owner:   user.Name,
+		Roles:   user.Roles,
+		Groups:  user.Groups,
+		Job:     data,
+		StartAt: startAt,
+	})
+}
+
+// restoreDelayedJobs starts again the jobs which were waiting for their start time before the restart, with their ID and owner.
+// The jobs whose start time passed meanwhile are started right away.
+func (s *Server) restoreDelayedJobs() {
+	for _, delayed := range s.DelayedJobs.Restored() {
+		log := logrus.WithFields(logrus.Fields{
+			"Action": "RestoreDelayedJob",
+			"JobID":  delayed.JobID,
+		})
+		r := &proto.StartJobRequest{}
+		if err := protojson.Unmarshal(delayed.Job, r); err != nil {
+			log.WithError(err).Error("failed to decode delayed job")
+			continue
+		}
+		r.StartAt = delayed.StartAt.Unix()
+		r.StartAfterSeconds = 0
+		user := &User{Name: delayed.Owner, Roles: delayed.Roles, Groups: delayed.Groups}
+		if _, err := s.startJob(user, r, delayed.JobID); err != nil {
+			log.WithError(err).Error("failed to restore delayed job")
+		}
+	}
+	if err := s.DelayedJobs.Save(); err != nil {
+		logrus.WithField("Action", "RestoreDelayedJob").Error(err)
+	}
+}
+
+// startScheduledJob starts the job of a schedule run as the schedule owner and records it in the audit log
+func (s *Server) startScheduledJob(scheduleID string, user *User, r *proto.StartJobRequest) (string, error) {
+	jobID, err := s.startJob(user, r, "")
+	rec := AuditRecord{
+		User:     user.Name,
+		Roles:    user.Roles,
+		Method:   "/proto.WorkerService/StartJob",
+		JobID:    jobID,
+		Cmd:      r.GetCmd(),
+		Args:     r.GetArgs(),
+		Decision: decisionAllowed,
+		Reason:   "schedule " + scheduleID,
+		Outcome:  status.Code(err).String(),
+	}
+	if err != nil {
+		rec.Error = status.Convert(err).Message()
+	}
+	s.AuditLog.Record(rec)
+	return jobID, err
+}
+
+func (s *Server) CreateSchedule(ctx context.Context, in *proto.CreateScheduleRequest) (*proto.CreateScheduleResponse, error) {
+	user, ok := UserFromContext(ctx)
+	if !ok || user.Name == "" {
+		return nil, status.Errorf(codes.Internal, "failed to verify user")
+	}
+	if in.GetJob() == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "missing job")
+	}
+	if _, err := s.jobSpecFromRequest(user, in.GetJob()); err != nil {
+		return nil, err
+	}
+	sched, err := s.Schedules.Create(user, in.GetCron(), in.GetConcurrencyPolicy(), in.GetJob())
+	if errors.Is(err, ErrInvalidSchedule) {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if err != nil {
+		logrus.WithField("Action", "CreateSchedule").Error(err)
+		return nil, status.Errorf(codes.Internal, "failed to create schedule")
+	}
+	return &proto.CreateScheduleResponse{
+		Schedule: scheduleToProto(sched),
+	}, nil
+}
+
+func (s *Server) ListSchedules(ctx context.Context, in *proto.ListSchedulesRequest) (*proto.ListSchedulesResponse, error) {
+	user, ok := UserFromContext(ctx)
+	if !ok || user.Name == "" {
+		return nil, status.Errorf(codes.Internal, "failed to verify user")
+	}
+	owner := user.Name
+	if contains("admin", user.Roles) {
+		owner = ""
+	}
+	res := &proto.ListSchedulesResponse{}
+	for _, sched := range s.Schedules.List(owner) {
+		res.Schedules = append(res.Schedules, scheduleToProto(sched))
+	}
+	return res, nil
+}
+
+func (s *Server) DeleteSchedule(ctx context.Context, in *proto.DeleteScheduleRequest) (*proto.DeleteScheduleResponse, error) {
+	user, ok := UserFromContext(ctx)
+	if !ok || user.Name == "" {
+		return nil, status.Errorf(codes.Internal, "failed to verify user")
+	}
+	sched, err := s.Schedules.Get(in.GetId())
+	if err != nil || (sched.Owner != user.Name && !contains("admin", user.Roles)) {
+		return nil, status.Errorf(codes.NotFound, "schedule not found: %v", in.GetId())
+	}
+	if err := s.Schedules.Delete(in.GetId()); err != nil {
+		logrus.WithField("Action", "DeleteSchedule").Error(err)
+		return nil, status.Errorf(codes.Internal, "failed to delete schedule: %v", in.GetId())
+	}
+	return &proto.DeleteScheduleResponse{}, nil
+}
+
+func (s *Server) GetQuotaUsage(ctx context.Context, in *proto.GetQuotaUsageRequest) (*proto.GetQuotaUsageResponse, error) {
+	user, ok := UserFromContext(ctx)
+	if !ok || user.Name == "" {
+		return nil, status.Errorf(codes.Internal, "failed to verify user")
+	}
+	quota := s.Quotas.QuotaFor(user)
+	usage := s.Quotas.Usage(user.Name)
+	return &proto.GetQuotaUsageResponse{
+		RunningJobs:    int32(usage.RunningJobs),
+		MaxRunningJobs: int32(quota.MaxRunningJobs),
+		MemoryBytes:    usage.MemoryBytes,
+		MaxMemoryBytes: quota.MaxMemoryBytes,
+		CpuMillis:      usage.CPUMillis,
+		MaxCpuMillis:   quota.MaxCPUMillis,
+		JobsLastHour:   int32(usage.JobsLastHour),
+		MaxJobsPerHour: int32(quota.MaxJobsPerHour),
+	}, nil
 }
 
 func (s *Server) StopJob(ctx context.Context, in *proto.StopJobRequest) (*proto.StopJobResponse, error) {
@@ -49,6 +316,9 @@ func (s *Server) StopJob(ctx context.Context, in *proto.StopJobRequest) (*proto.
 		logrus.WithFields(logFields).Error(err)
 		return nil, status.Errorf(codes.InvalidArgument, "failed to stop job: %v", jobID)
 	}
+	if err := s.DelayedJobs.Remove(jobID); err != nil {
+		logrus.WithFields(logFields).Error(err)
+	}
 	return &proto.StopJobResponse{}, nil
 }
 
@@ -63,31 +333,397 @@ func (s *Server) GetJobStatus(ctx context.Context, in *proto.GetStatusRequest) (
 		logrus.WithFields(logFields).Error(err)
 		return nil, status.Errorf(codes.InvalidArgument, "failed to fetch status for job: %v", jobID)
 	}
-	var jobStatus proto.Status
-	switch stat.JobStatus {
-	case worker.Running:
-		jobStatus = proto.Status_RUNNING
-	case worker.Finished:
-		jobStatus = proto.Status_FINISHED
-	case worker.Stopped:
-		jobStatus = proto.Status_STOPPED
-	default:
+	jobStatus, ok := statusToProto(stat.JobStatus)
+	if !ok {
 		logrus.WithFields(logFields).Errorf("job with invalid status: %v", stat.JobStatus)
 		return nil, status.Errorf(codes.InvalidArgument, "job: %v has invalid status", jobID)
 	}
-	return &proto.GetStatusResponse{
-		Status:   jobStatus,
-		Exitcode: int32(stat.ExitCode),
+	res := &proto.GetStatusResponse{
+		Status:        jobStatus,
+		Exitcode:      int32(stat.ExitCode),
+		QueuePosition: int32(stat.QueuePosition),
+		Reason:        stat.Reason,
+		Attempt:       int32(stat.Attempt),
+		Restarts:      int32(stat.Restarts),
+		Execs:         int32(stat.Execs),
+	}
+	if !stat.StartAt.IsZero() {
+		res.StartAt = stat.StartAt.Unix()
+	}
+	if stat.LastExit != nil {
+		exitStatus, _ := statusToProto(stat.LastExit.Status)
+		res.LastExit = &proto.Exit{
+			Attempt:  int32(stat.LastExit.Attempt),
+			Status:   exitStatus,
+			Exitcode: int32(stat.LastExit.ExitCode),
+			Time:     stat.LastExit.Time.Unix(),
+		}
+	}
+	return res, nil
+}
+
+func (s *Server) StartWorkflow(ctx context.Context, in *proto.StartWorkflowRequest) (*proto.StartWorkflowResponse, error) {
+	log := logrus.WithField("Action", "StartWorkflow")
+	user, ok := UserFromContext(ctx)
+	if !ok || user.Name == "" {
+		return nil, status.Errorf(codes.Internal, "failed to verify user")
+	}
+	if in.Group != "" && !contains(in.Group, user.Groups) {
+		return nil, status.Errorf(codes.PermissionDenied, "user is not a member of group: %v", in.Group)
+	}
+	var steps []worker.WorkflowStep
+	var limits []worker.Limits
+	// the steps are admitted as their dependencies end without another quota check, they are all charged up front
+	var admitted []int
+	for _, step := range in.GetSteps() {
+		job := step.GetJob()
+		switch {
+		case job == nil:
+			return nil, status.Errorf(codes.InvalidArgument, "step %v has no job", step.GetName())
+		case job.StartAt != 0 || job.StartAfterSeconds != 0:
+			return nil, status.Errorf(codes.InvalidArgument, "step %v: workflow steps cannot be delayed", step.GetName())
+		case job.Group != "" && job.Group != in.Group:
+			return nil, status.Errorf(codes.InvalidArgument, "step %v: workflow steps are shared with the workflow group", step.GetName())
+		}
+		spec, err := s.jobSpecFromRequest(user, job)
+		if err != nil {
+			return nil, err
+		}
+		ws := worker.WorkflowStep{Name: step.GetName(), Spec: spec}
+		for _, dep := range step.GetDependsOn() {
+			ws.DependsOn = append(ws.DependsOn, worker.Dependency{Step: dep.GetStep(), Condition: dep.GetCondition()})
+		}
+		admitted = append(admitted, len(steps))
+		steps = append(steps, ws)
+		limits = append(limits, spec.Limits)
+	}
+
+	var wf worker.Workflow
+	_, err := s.Quotas.ReserveAll(user, limits, admitted, func() ([]string, error) {
+		var err error
+		wf, err = s.Worker.StartWorkflow(steps)
+		if err != nil {
+			return nil, err
+		}
+		jobIDs := make([]string, len(steps))
+		for i, step := range steps {
+			jobIDs[i] = wf.Jobs[step.Name]
+		}
+		return jobIDs, nil
+	})
+	var quotaErr *QuotaError
+	switch {
+	case errors.As(err, &quotaErr):
+		log.WithError(err).Info("workflow rejected by quota")
+		return nil, status.Errorf(codes.ResourceExhausted, "%v", quotaErr)
+	case errors.Is(err, worker.ErrInsufficientCapacity):
+		log.WithError(err).Info("workflow rejected by admission control")
+		return nil, status.Errorf(codes.ResourceExhausted, "job limits do not fit in the host capacity")
+	case errors.Is(err, worker.ErrInvalidWorkflow):
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	case errors.Is(err, worker.ErrNameInUse):
+		return nil, status.Errorf(codes.AlreadyExists, "%v", err)
+	case err != nil:
+		log.WithError(err).Error("failed to start workflow")
+		return nil, status.Errorf(codes.Internal, "failed to start workflow")
+	}
+
+	owner := store.Owner{User: user.Name, Group: in.Group}
+	if err := s.UserJobStore.SetJobOwner(wf.ID, owner); err != nil {
+		log.WithError(err).Error("failed to start workflow")
+		return nil, status.Errorf(codes.Internal, "failed to save workflow for user")
+	}
+	for _, step := range steps {
+		jobID := wf.Jobs[step.Name]
+		if err := s.UserJobStore.SetJobOwner(jobID, owner); err != nil {
+			log.WithError(err).Error("failed to start workflow")
+			return nil, status.Errorf(codes.Internal, "failed to save job for user")
+		}
+		if step.Spec.Name != "" {
+			s.UserJobStore.SetJobName(user.Name, step.Spec.Name, jobID)
+		}
+	}
+	return &proto.StartWorkflowResponse{
+		Id:     wf.ID,
+		JobIds: wf.Jobs,
+	}, nil
+}
+
+func (s *Server) GetWorkflowStatus(ctx context.Context, in *proto.GetWorkflowStatusRequest) (*proto.GetWorkflowStatusResponse, error) {
+	logFields := logrus.Fields{
+		"WorkflowID": in.GetId(),
+		"Action":     "GetWorkflowStatus",
+	}
+	stat, err := s.Worker.GetWorkflowStatus(in.GetId())
+	if err != nil {
+		logrus.WithFields(logFields).Error(err)
+		return nil, status.Errorf(codes.InvalidArgument, "failed to fetch status for workflow: %v", in.GetId())
+	}
+	res := &proto.GetWorkflowStatusResponse{
+		Status: workflowStatusToProto(stat.Status),
+	}
+	for _, step := range stat.Steps {
+		stepStatus, _ := statusToProto(step.JobStatus)
+		res.Steps = append(res.Steps, &proto.StepStatus{
+			Name:     step.Name,
+			JobId:    step.JobID,
+			Status:   stepStatus,
+			Exitcode: int32(step.ExitCode),
+			Reason:   step.Reason,
+		})
+	}
+	return res, nil
+}
+
+func (s *Server) StopWorkflow(ctx context.Context, in *proto.StopWorkflowRequest) (*proto.StopWorkflowResponse, error) {
+	logFields := logrus.Fields{
+		"WorkflowID": in.GetId(),
+		"Action":     "StopWorkflow",
+	}
+	if err := s.Worker.StopWorkflow(in.GetId()); err != nil {
+		logrus.WithFields(logFields).Error(err)
+		return nil, status.Errorf(codes.InvalidArgument, "failed to stop workflow: %v", in.GetId())
+	}
+	return &proto.StopWorkflowResponse{}, nil
+}
+
+func (s *Server) StartBatch(ctx context.Context, in *proto.StartBatchRequest) (*proto.StartBatchResponse, error) {
+	log := logrus.WithField("Action", "StartBatch")
+	user, ok := UserFromContext(ctx)
+	if !ok || user.Name == "" {
+		return nil, status.Errorf(codes.Internal, "failed to verify user")
+	}
+	job := in.GetJob()
+	switch {
+	case job == nil:
+		return nil, status.Errorf(codes.InvalidArgument, "missing job")
+	case job.StartAt != 0 || job.StartAfterSeconds != 0:
+		return nil, status.Errorf(codes.InvalidArgument, "batch jobs cannot be delayed")
+	}
+	params, err := batchParams(in)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	// the name of the template holds placeholders, the name of each job is validated once expanded
+	name := job.GetName()
+	job = gproto.Clone(job).(*proto.StartJobRequest)
+	job.Name = ""
+	template, err := s.jobSpecFromRequest(user, job)
+	if err != nil {
+		return nil, err
+	}
+	template.Name = name
+	names := make([]string, len(params))
+	if name != "" {
+		for i, param := range params {
+			names[i] = strings.NewReplacer(worker.BatchParamPlaceholder, param, worker.BatchIndexPlaceholder, strconv.Itoa(i)).Replace(name)
+			if err := validateJobName(names[i]); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+			}
+		}
+	}
+	spec := worker.BatchSpec{
+		Template:    template,
+		Params:      params,
+		Parallelism: int(in.GetParallelism()),
+	}
+
+	limits := make([]worker.Limits, len(params))
+	for i := range limits {
+		limits[i] = template.Limits
+	}
+	// the first jobs are admitted up to the parallelism, the other ones wait for a batch slot
+	admitted := make([]int, len(params))
+	if spec.Parallelism > 0 && spec.Parallelism < len(params) {
+		admitted = admitted[:spec.Parallelism]
+	}
+	for i := range admitted {
+		admitted[i] = i
+	}
+	var b worker.Batch
+	_, err = s.Quotas.ReserveAll(user, limits, admitted, func() ([]string, error) {
+		var err error
+		b, err = s.Worker.StartBatch(spec)
+		return b.Jobs, err
+	})
+	var quotaErr *QuotaError
+	switch {
+	case errors.As(err, &quotaErr):
+		log.WithError(err).Info("batch rejected by quota")
+		return nil, status.Errorf(codes.ResourceExhausted, "%v", quotaErr)
+	case errors.Is(err, worker.ErrInsufficientCapacity):
+		log.WithError(err).Info("batch rejected by admission control")
+		return nil, status.Errorf(codes.ResourceExhausted, "job limits do not fit in the host capacity")
+	case errors.Is(err, worker.ErrNameInUse):
+		return nil, status.Errorf(codes.AlreadyExists, "%v", err)
+	case err != nil:
+		log.WithError(err).Error("failed to start batch")
+		return nil, status.Errorf(codes.Internal, "failed to start batch")
+	}
+
+	owner := store.Owner{User: user.Name, Group: job.Group}
+	for _, id := range append([]string{b.ID}, b.Jobs...) {
+		if err := s.UserJobStore.SetJobOwner(id, owner); err != nil {
+			log.WithError(err).Error("failed to start batch")
+			return nil, status.Errorf(codes.Internal, "failed to save batch for user")
+		}
+	}
+	if name != "" {
+		for i, jobID := range b.Jobs {
+			s.UserJobStore.SetJobName(user.Name, names[i], jobID)
+		}
+	}
+	return &proto.StartBatchResponse{
+		Id:     b.ID,
+		JobIds: b.Jobs,
 	}, nil
 }
 
+func (s *Server) GetBatchStatus(ctx context.Context, in *proto.GetBatchStatusRequest) (*proto.GetBatchStatusResponse, error) {
+	logFields := logrus.Fields{
+		"BatchID": in.GetId(),
+		"Action":  "GetBatchStatus",
+	}
+	stat, err := s.Worker.GetBatchStatus(in.GetId())
+	if err != nil {
+		logrus.WithFields(logFields).Error(err)
+		return nil, status.Errorf(codes.InvalidArgument, "failed to fetch status for batch: %v", in.GetId())
+	}
+	res := &proto.GetBatchStatusResponse{
+		Total:     int32(len(stat.Jobs)),
+		Succeeded: int32(stat.Succeeded),
+		Failed:    int32(stat.Failed),
+		Running:   int32(stat.Running),
+		Pending:   int32(stat.Pending),
+		Stopped:   stat.Stopped,
+	}
+	for _, job := range stat.Jobs {
+		jobStatus, _ := statusToProto(job.JobStatus)
+		res.Jobs = append(res.Jobs, &proto.BatchJobStatus{
+			Index:    int32(job.Index),
+			Param:    job.Param,
+			JobId:    job.JobID,
+			Status:   jobStatus,
+			Exitcode: int32(job.ExitCode),
+		})
+	}
+	return res, nil
+}
+
+func (s *Server) StopBatch(ctx context.Context, in *proto.StopBatchRequest) (*proto.StopBatchResponse, error) {
+	logFields := logrus.Fields{
+		"BatchID": in.GetId(),
+		"Action":  "StopBatch",
+	}
+	if err := s.Worker.StopBatch(in.GetId()); err != nil {
+		logrus.WithFields(logFields).Error(err)
+		return nil, status.Errorf(codes.InvalidArgument, "failed to stop batch: %v", in.GetId())
+	}
+	return &proto.StopBatchResponse{}, nil
+}
+
+func (s *Server) ListJobs(ctx context.Context, in *proto.ListJobsRequest) (*proto.ListJobsResponse, error) {
+	user, ok := UserFromContext(ctx)
+	if !ok || user.Name == "" {
+		return nil, status.Errorf(codes.Internal, "failed to verify user")
+	}
+	selector, err := ParseLabelSelector(in.GetLabelSelector())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	res := &proto.ListJobsResponse{}
+	for _, job := range s.selectJobs(user, JobSelector{Labels: selector}, "/proto.WorkerService/GetJobStatus") {
+		res.Jobs = append(res.Jobs, jobInfoToProto(job))
+	}
+	return res, nil
+}
+
+func (s *Server) StopJobs(ctx context.Context, in *proto.StopJobsRequest) (*proto.StopJobsResponse, error) {
+	user, ok := UserFromContext(ctx)
+	if !ok || user.Name == "" {
+		return nil, status.Errorf(codes.Internal, "failed to verify user")
+	}
+	labels, err := ParseLabelSelector(in.GetLabelSelector())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	selector := JobSelector{Owner: in.GetOwner(), Labels: labels, Cmd: in.GetCmd()}
+	for _, stat := range in.GetStatuses() {
+		jobStatus, ok := statusFromProto(stat)
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown status: %v", stat)
+		}
+		selector.Statuses = append(selector.Statuses, jobStatus)
+	}
+	if selector.Empty() {
+		return nil, status.Errorf(codes.InvalidArgument, "missing selector")
+	}
+
+	res := &proto.StopJobsResponse{}
+	for _, job := range s.selectJobs(user, selector, "/proto.WorkerService/StopJob") {
+		if job.JobStatus.Terminal() {
+			continue
+		}
+		jobStatus, _ := statusToProto(job.JobStatus)
+		result := &proto.StopJobResult{Id: job.ID, Name: job.Spec.Name, Owner: job.Spec.Owner, Status: jobStatus}
+		res.Results = append(res.Results, result)
+		if in.GetDryRun() {
+			continue
+		}
+		logFields := logrus.Fields{"JobID": job.ID, "Action": "StopJobs"}
+		err := s.Worker.Stop(job.ID)
+		if err != nil {
+			logrus.WithFields(logFields).Error(err)
+			result.Error = "failed to stop job"
+		} else if err := s.DelayedJobs.Remove(job.ID); err != nil {
+			logrus.WithFields(logFields).Error(err)
+		}
+		s.auditStop(user, job, err)
+	}
+	return res, nil
+}
+
+// auditStop records a job stopped by StopJobs in the audit log, so that the job audit trail shows who stopped it
+func (s *Server) auditStop(user *User, job worker.JobInfo, err error) {
+	rec := AuditRecord{
+		User:     user.Name,
+		Roles:    user.Roles,
+		Method:   "/proto.WorkerService/StopJob",
+		JobID:    job.ID,
+		Decision: decisionAllowed,
+		Reason:   "StopJobs",
+		Outcome:  codes.OK.String(),
+	}
+	if err != nil {
+		rec.Outcome = codes.InvalidArgument.String()
+		rec.Error = err.Error()
+	}
+	s.AuditLog.Record(rec)
+}
+
+// selectJobs returns the jobs matching the selector which the user can call the method on
+func (s *Server) selectJobs(user *User, selector JobSelector, method string) []worker.JobInfo {
+	var jobs []worker.JobInfo
+	for _, job := range s.Worker.List() {
+		if !selector.Matches(job) {
+			continue
+		}
+		owner, err := s.UserJobStore.GetOwner(job.ID)
+		if err != nil || !canAccessJob(user, owner, s.Config.GroupAccess, method) {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
 func (s *Server) GetOutputStream(r *proto.GetStreamRequest, stream proto.WorkerService_GetOutputStreamServer) error {
 	jobID := r.GetId()
 	logFields := logrus.Fields{
 		"JobID":  jobID,
 		"Action": "GetOutputStream",
 	}
-	logchan, err := s.Worker.GetOutput(stream.Context(), jobID)
+	logchan, err := s.Worker.GetOutput(stream.Context(), jobID, int(r.GetAttempt()))
 	if err != nil {
 		logrus.WithFields(logFields).Error(err)
 		return status.Errorf(codes.Internal, "failed to get stream output of job: %v", jobID)
@@ -107,3 +743,225 @@ func (s *Server) GetOutputStream(r *proto.GetStreamRequest, stream proto.WorkerS
 		}
 	}
 }
+
+func (s *Server) WriteStdin(stream proto.WorkerService_WriteStdinServer) error {
+	var jobID string
+	var written int64
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&proto.WriteStdinResponse{BytesWritten: written})
+		}
+		if err != nil {
+			return err
+		}
+		if jobID == "" {
+			if jobID = in.GetId(); jobID == "" {
+				return status.Errorf(codes.InvalidArgument, "missing job id")
+			}
+		}
+		logFields := logrus.Fields{
+			"JobID":  jobID,
+			"Action": "WriteStdin",
+		}
+		if len(in.GetData()) > 0 {
+			if err := s.Worker.WriteStdin(jobID, in.GetData()); err != nil {
+				logrus.WithFields(logFields).Error(err)
+				return stdinError(jobID, err)
+			}
+			written += int64(len(in.GetData()))
+		}
+		if in.GetClose() {
+			if err := s.Worker.CloseStdin(jobID); err != nil {
+				logrus.WithFields(logFields).Error(err)
+				return stdinError(jobID, err)
+			}
+			return stream.SendAndClose(&proto.WriteStdinResponse{BytesWritten: written})
+		}
+	}
+}
+
+func (s *Server) AttachJob(stream proto.WorkerService_AttachJobServer) error {
+	in, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	jobID := in.GetId()
+	logFields := logrus.Fields{
+		"JobID":  jobID,
+		"Action": "AttachJob",
+	}
+	if in.GetWrite() {
+		// the input is restricted to the owner like the stdin of the job
+		user, ok := UserFromContext(stream.Context())
+		owner, err := s.UserJobStore.GetOwner(jobID)
+		if !ok || user.ShareToken || err != nil || owner.User != user.Name {
+			return status.Errorf(codes.PermissionDenied, "only the owner of the job can attach as the writer")
+		}
+	}
+	session, err := s.Worker.Attach(jobID, in.GetWrite())
+	switch {
+	case errors.Is(err, worker.ErrNoTTY), errors.Is(err, worker.ErrWriterAttached):
+		return status.Errorf(codes.FailedPrecondition, "%v", err)
+	case err != nil:
+		logrus.WithFields(logFields).Error(err)
+		return status.Errorf(codes.FailedPrecondition, "failed to attach to job: %v", jobID)
+	}
+	defer session.Detach()
+
+	// the input is read in its own goroutine while the output is sent, the session is detached when the client ends the stream
+	errc := make(chan error, 1)
+	go func(in *proto.AttachRequest) {
+		for {
+			if err := attachInput(session, in); err != nil {
+				errc <- err
+				return
+			}
+			var err error
+			if in, err = stream.Recv(); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				errc <- err
+				return
+			}
+		}
+	}(in)
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case output, ok := <-session.Output():
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(&proto.AttachResponse{Output: output}); err != nil {
+				logrus.WithFields(logFields).Error(err)
+				return status.Errorf(codes.Internal, "failed to send output of job: %v", jobID)
+			}
+		}
+	}
+}
+
+func (s *Server) ExecInJob(in *proto.ExecRequest, stream proto.WorkerService_ExecInJobServer) error {
+	jobID := in.GetId()
+	logFields := logrus.Fields{
+		"JobID":  jobID,
+		"Action": "ExecInJob",
+	}
+	if err := validateEnv(in.GetEnv()); err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	spec := worker.ExecSpec{
+		Cmd:   in.GetCmd(),
+		Args:  in.GetArgs(),
+		Env:   in.GetEnv(),
+		Stdin: in.GetStdin(),
+	}
+	// the process is killed when the stream ends
+	e, err := s.Worker.Exec(stream.Context(), jobID, spec)
+	if err != nil {
+		logrus.WithFields(logFields).Error(err)
+		return status.Errorf(codes.FailedPrecondition, "failed to exec in job: %v", jobID)
+	}
+	for output := range e.Output() {
+		if err := stream.Send(&proto.ExecResponse{Output: output}); err != nil {
+			logrus.WithFields(logFields).Error(err)
+			return status.Errorf(codes.Internal, "failed to send output of exec in job: %v", jobID)
+		}
+	}
+	return stream.Send(&proto.ExecResponse{Exited: true, Exitcode: int32(e.Wait())})
+}
+
+// attachInput forwards the input and the window size of an AttachJob message to the terminal
+func attachInput(session *worker.Session, in *proto.AttachRequest) error {
+	if size := in.GetResize(); size != nil {
+		if size.GetRows() > math.MaxUint16 || size.GetCols() > math.MaxUint16 {
+			return status.Errorf(codes.InvalidArgument, "invalid window size")
+		}
+		if err := session.Resize(uint16(size.GetRows()), uint16(size.GetCols())); err != nil {
+			return sessionError(err)
+		}
+	}
+	if len(in.GetInput()) > 0 {
+		if err := session.Write(in.GetInput()); err != nil {
+			return sessionError(err)
+		}
+	}
+	return nil
+}
+
+// sessionError converts an error of a terminal session to a gRPC status error
+func sessionError(err error) error {
+	switch {
+	case errors.Is(err, worker.ErrReadOnlySession):
+		return status.Errorf(codes.PermissionDenied, "%v", err)
+	case errors.Is(err, worker.ErrDetached):
+		return status.Errorf(codes.FailedPrecondition, "%v", err)
+	default:
+		return status.Errorf(codes.FailedPrecondition, "failed to write to the terminal: %v", err)
+	}
+}
+
+// stdinError converts an error writing to the stdin of a job to a gRPC status error
+func stdinError(jobID string, err error) error {
+	if errors.Is(err, worker.ErrStdinNotOpen) || errors.Is(err, worker.ErrStdinClosed) {
+		return status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+	return status.Errorf(codes.FailedPrecondition, "failed to write to the stdin of job: %v", jobID)
+}
+
+func (s *Server) CreateShareToken(ctx context.Context, in *proto.CreateShareTokenRequest) (*proto.CreateShareTokenResponse, error) {
+	jobID := in.GetId()
+	logFields := logrus.Fields{
+		"JobID":  jobID,
+		"Action": "CreateShareToken",
+	}
+	if _, err := s.Worker.GetStatus(jobID); err != nil {
+		logrus.WithFields(logFields).Error(err)
+		return nil, status.Errorf(codes.InvalidArgument, "failed to find job: %v", jobID)
+	}
+	token, expiresAt, err := s.ShareTokens.Issue(jobID, time.Duration(in.GetTtlSeconds())*time.Second)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to create share token: %v", err)
+	}
+	return &proto.CreateShareTokenResponse{
+		Token:     token,
+		ExpiresAt: expiresAt.Unix(),
+	}, nil
+}
+
+func (s *Server) QueryAudit(ctx context.Context, in *proto.QueryAuditRequest) (*proto.QueryAuditResponse, error) {
+	filter := AuditFilter{
+		User:  in.GetUser(),
+		JobID: in.GetJobId(),
+	}
+	if in.GetSince() != 0 {
+		filter.Since = time.Unix(in.GetSince(), 0)
+	}
+	if in.GetUntil() != 0 {
+		filter.Until = time.Unix(in.GetUntil(), 0)
+	}
+	records, err := s.AuditLog.Query(filter)
+	if err != nil {
+		logrus.WithField("Action", "QueryAudit").Error(err)
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to query audit log")
+	}
+	res := &proto.QueryAuditResponse{}
+	for _, rec := range records {
+		res.Records = append(res.Records, &proto.AuditRecord{
+			Time:     rec.Time.Unix(),
+			User:     rec.User,
+			Roles:    rec.Roles,
+			Method:   rec.Method,
+			JobId:    rec.JobID,
+			Cmd:      rec.Cmd,
+			Args:     rec.Args,
+			Decision: rec.Decision,
+			Reason:   rec.Reason,
+			Outcome:  rec.Outcome,
+			Error:    rec.Error,
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+// Authorization decisions recorded in the audit log
+const (
+	decisionAllowed = "allowed"
+	decisionDenied  = "denied"
+)
+
+// maxAuditRecordSize bounds the size of a line read from the audit log, large args could exceed the default scanner buffer
+const maxAuditRecordSize = 1024 * 1024
+
+// AuditRecord is a single entry of the audit log, written as a JSON line
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user,omitempty"`
+	Roles    []string  `json:"roles,omitempty"`
+	Method   string    `json:"method"`
+	JobID    string    `json:"job_id,omitempty"`
+	Cmd      string    `json:"cmd,omitempty"`
+	Args     []string  `json:"args,omitempty"`
+	Decision string    `json:"decision"`
+	Reason   string    `json:"reason,omitempty"`
+	// Outcome is the gRPC status code returned to the caller
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// AuditFilter selects audit records, empty fields match all records
+type AuditFilter struct {
+	User  string
+	JobID string
+	Since time.Time
+	Until time.Time
+}
+
+func (f AuditFilter) match(rec AuditRecord) bool {
+	if f.User != "" && rec.User != f.User {
+		return false
+	}
+	if f.JobID != "" && rec.JobID != f.JobID {
+		return false
+	}
+	if !f.Since.IsZero() && rec.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && rec.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditLog appends the audit records to a file, one JSON object per line.
+// Auditing is disabled when no file is configured.
+type AuditLog struct {
+	path string
+	file *os.File
+	sync.Mutex
+}
+
+func NewAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{path: path}
+	if path == "" {
+		return a, nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	a.file = file
+	return a, nil
+}
+
+// Record appends the record to the audit log. Failures are logged as the request outcome must not depend on auditing.
+func (a *AuditLog) Record(rec AuditRecord) {
+	if a.file == nil {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		logrus.Errorf("failed to encode audit record: %v", err)
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		logrus.Errorf("failed to write audit record: %v", err)
+	}
+}
+
+// Query returns the audit records matching the filter in the order they were recorded
+func (a *AuditLog) Query(filter AuditFilter) ([]AuditRecord, error) {
+	if a.file == nil {
+		return nil, errors.New("audit log is disabled")
+	}
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxAuditRecordSize)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			logrus.Errorf("skipping malformed audit record: %v", err)
+			continue
+		}
+		if filter.match(rec) {
+			records = append(records, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return records, nil
+}
+
+func (a *AuditLog) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
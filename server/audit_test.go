@@ -0,0 +1,41 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog_RecordQuery(t *testing.T) {
+	a, err := NewAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	assert.NoError(t, err)
+	defer a.Close()
+
+	start := time.Now()
+	a.Record(AuditRecord{User: "alice", Method: "/proto.WorkerService/StartJob", JobID: "job-1", Cmd: "echo", Decision: decisionAllowed, Outcome: "OK"})
+	a.Record(AuditRecord{User: "bob", Method: "/proto.WorkerService/StopJob", JobID: "job-1", Decision: decisionDenied, Reason: "no access", Outcome: "PermissionDenied"})
+	a.Record(AuditRecord{User: "alice", Method: "/proto.WorkerService/GetJobStatus", JobID: "job-2", Decision: decisionAllowed, Outcome: "OK"})
+
+	records, err := a.Query(AuditFilter{User: "alice"})
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "echo", records[0].Cmd)
+
+	records, err = a.Query(AuditFilter{JobID: "job-1"})
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, decisionDenied, records[1].Decision)
+
+	records, err = a.Query(AuditFilter{Since: start.Add(-time.Minute), Until: start.Add(-time.Second)})
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func TestAuditLog_Disabled(t *testing.T) {
+	a, err := NewAuditLog("")
+	assert.NoError(t, err)
+	a.Record(AuditRecord{User: "alice"})
+	_, err = a.Query(AuditFilter{})
+	assert.Error(t, err)
+}
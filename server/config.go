@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mrinalirao/job-worker/worker"
+	"os"
+)
+
+// Config holds the server configuration.
+// It is loaded from a JSON file, fields missing in the file keep their default values.
+type Config struct {
+	Identity IdentityConfig `json:"identity"`
+	// GroupAccess is the access granted to the members of the group owning a job.
+	// "none": no access, "read": status and output stream, "control": read access and stopping the job.
+	GroupAccess string           `json:"group_access"`
+	ShareTokens ShareTokenConfig `json:"share_tokens"`
+	// AuditLogPath is the file the audit records are appended to, auditing is disabled when empty
+	AuditLogPath string `json:"audit_log_path"`
+	// SchedulesPath is the file the cron schedules are persisted to, schedules are lost on restart when empty
+	SchedulesPath string `json:"schedules_path"`
+	// DelayedJobsPath is the file the jobs waiting for their start time are persisted to, they are lost on restart when empty
+	DelayedJobsPath string          `json:"delayed_jobs_path"`
+	Quotas          QuotaConfig     `json:"quotas"`
+	RateLimits      RateLimitConfig `json:"rate_limits"`
+	Worker          worker.Config   `json:"worker"`
+	// IdempotencyWindowSeconds is how long the job started for an idempotency key is remembered
+	IdempotencyWindowSeconds int64 `json:"idempotency_window_seconds"`
+	// Exec restricts the environment and the working directory of the jobs
+	Exec ExecPolicy `json:"exec"`
+	// MaxPriority caps the priority of the jobs started by each role, a user with several roles gets the highest cap.
+	// Roles without a cap can only start jobs with the default priority 0.
+	MaxPriority map[string]int `json:"max_priority"`
+	// MinPriority is the lowest priority of the jobs, lower priorities are raised to it
+	MinPriority int `json:"min_priority"`
+}
+
+// DefaultConfig returns the configuration used when no config file is given.
+func DefaultConfig() Config {
+	return Config{
+		Identity: IdentityConfig{
+			Sources: []string{sourceCommonName},
+		},
+		GroupAccess: groupAccessRead,
+		ShareTokens: ShareTokenConfig{
+			DefaultTTLSeconds: 15 * 60,
+			MaxTTLSeconds:     24 * 60 * 60,
+		},
+		AuditLogPath:             "audit.log",
+		SchedulesPath:            "schedules.json",
+		DelayedJobsPath:          "delayed_jobs.json",
+		IdempotencyWindowSeconds: 24 * 60 * 60,
+		MinPriority:              -1000,
+		Exec: ExecPolicy{
+			InheritEnvRoles:    []string{"admin"},
+			AllowedWorkingDirs: []string{os.TempDir()},
+			RunAs: RunAsConfig{
+				Enabled: true,
+				// nobody
+				Default: Account{UID: 65534, GID: 65534},
+			},
+		},
+		Worker: worker.Config{
+			StopGracePeriodSeconds: 10,
+			WorkingDir:             "/",
+		},
+	}
+}
+
+// LoadConfig reads the JSON config file at path on top of the default configuration.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if err := cfg.Worker.Validate(); err != nil {
+		return cfg, fmt.Errorf("invalid worker config: %w", err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,20 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig_InvalidAdmission(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"worker": {"admission": "rejct"}}`), 0600))
+	_, err := LoadConfig(path)
+	assert.Error(t, err)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"worker": {"admission": "reject"}}`), 0600))
+	cfg, err := LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "reject", cfg.Worker.Admission)
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DelayedJob is a job held by the worker until its start time, persisted so that it is started after a restart
+type DelayedJob struct {
+	JobID string `json:"job_id"`
+	// Owner, Roles and Groups are the identity of the user who started the job
+	Owner  string   `json:"owner"`
+	Roles  []string `json:"roles,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Job is the StartJob request in protobuf JSON, with the absolute start time
+	Job     json.RawMessage `json:"job"`
+	StartAt time.Time       `json:"start_at"`
+}
+
+type delayedEntry struct {
+	DelayedJob
+	timer *time.Timer
+}
+
+// DelayedJobs persists the jobs which are not started yet to a JSON file, a job is dropped once its start time is reached
+// or when it is stopped. Persistence is disabled when no file is configured.
+type DelayedJobs struct {
+	path string
+	jobs map[string]*delayedEntry
+	// restored holds the jobs read from the file at startup, to be started again
+	restored []DelayedJob
+	sync.Mutex
+}
+
+// NewDelayedJobs reads the jobs persisted at path, they are returned by Restored
+func NewDelayedJobs(path string) (*DelayedJobs, error) {
+	d := &DelayedJobs{
+		path: path,
+		jobs: make(map[string]*delayedEntry),
+	}
+	if path == "" {
+		return d, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delayed jobs: %w", err)
+	}
+	if err := json.Unmarshal(data, &d.restored); err != nil {
+		return nil, fmt.Errorf("failed to parse delayed jobs: %w", err)
+	}
+	return d, nil
+}
+
+// Restored returns the jobs persisted before the restart. The jobs which are not added again are dropped by the next Save.
+func (d *DelayedJobs) Restored() []DelayedJob {
+	return d.restored
+}
+
+// Add persists the job until its start time
+func (d *DelayedJobs) Add(job DelayedJob) error {
+	d.Lock()
+	defer d.Unlock()
+	if entry, ok := d.jobs[job.JobID]; ok {
+		entry.timer.Stop()
+	}
+	d.jobs[job.JobID] = &delayedEntry{
+		DelayedJob: job,
+		timer: time.AfterFunc(time.Until(job.StartAt), func() {
+			if err := d.Remove(job.JobID); err != nil {
+				logrus.WithField("JobID", job.JobID).Errorf("failed to save delayed jobs: %v", err)
+			}
+		}),
+	}
+	return d.save()
+}
+
+// Remove drops the job, it is a no-op for jobs which are not delayed
+func (d *DelayedJobs) Remove(jobID string) error {
+	d.Lock()
+	defer d.Unlock()
+	entry, ok := d.jobs[jobID]
+	if !ok {
+		return nil
+	}
+	entry.timer.Stop()
+	delete(d.jobs, jobID)
+	return d.save()
+}
+
+// Save writes the delayed jobs to the file
+func (d *DelayedJobs) Save() error {
+	d.Lock()
+	defer d.Unlock()
+	d.restored = nil
+	return d.save()
+}
+
+// save writes the jobs to a temporary file renamed over the file, the caller must hold the lock
+func (d *DelayedJobs) save() error {
+	if d.path == "" {
+		return nil
+	}
+	jobs := make([]DelayedJob, 0, len(d.jobs))
+	for _, entry := range d.jobs {
+		jobs = append(jobs, entry.DelayedJob)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartAt.Before(jobs[j].StartAt)
+	})
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode delayed jobs: %w", err)
+	}
+	tmp := d.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write delayed jobs: %w", err)
+	}
+	if err := os.Rename(tmp, d.path); err != nil {
+		return fmt.Errorf("failed to write delayed jobs: %w", err)
+	}
+	return nil
+}
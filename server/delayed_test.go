@@ -0,0 +1,41 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDelayedJobs_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "delayed_jobs.json")
+	d, err := NewDelayedJobs(path)
+	assert.NoError(t, err)
+	assert.NoError(t, d.Add(DelayedJob{JobID: "1", Owner: "alice", Job: []byte(`{"cmd":"echo"}`), StartAt: time.Now().Add(time.Hour)}))
+	assert.NoError(t, d.Add(DelayedJob{JobID: "2", Owner: "bob", Job: []byte(`{"cmd":"true"}`), StartAt: time.Now().Add(time.Hour)}))
+	assert.NoError(t, d.Remove("2"))
+
+	restored, err := NewDelayedJobs(path)
+	assert.NoError(t, err)
+	jobs := restored.Restored()
+	assert.Equal(t, 1, len(jobs))
+	assert.Equal(t, "alice", jobs[0].Owner)
+	assert.JSONEq(t, `{"cmd":"echo"}`, string(jobs[0].Job))
+
+	// the jobs which are not added again are dropped
+	assert.NoError(t, restored.Save())
+	restored, err = NewDelayedJobs(path)
+	assert.NoError(t, err)
+	assert.Empty(t, restored.Restored())
+}
+
+func TestDelayedJobs_DroppedAtStartTime(t *testing.T) {
+	d, err := NewDelayedJobs("")
+	assert.NoError(t, err)
+	assert.NoError(t, d.Add(DelayedJob{JobID: "1", StartAt: time.Now().Add(50 * time.Millisecond)}))
+	assert.Eventually(t, func() bool {
+		d.Lock()
+		defer d.Unlock()
+		return len(d.jobs) == 0
+	}, time.Second, 10*time.Millisecond)
+}
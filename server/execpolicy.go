@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mrinalirao/job-worker/worker"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExecPolicy restricts how the processes of the jobs are run.
+type ExecPolicy struct {
+	// InheritEnvRoles are the roles allowed to start jobs with the environment of the server
+	InheritEnvRoles []string `json:"inherit_env_roles"`
+	// AllowedWorkingDirs are the directories, along with their subdirectories, the jobs can be started in.
+	// No working directory can be requested when empty.
+	AllowedWorkingDirs []string    `json:"allowed_working_dirs"`
+	RunAs              RunAsConfig `json:"run_as"`
+}
+
+// Account is a local Linux account the jobs run as
+type Account struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+	// Groups are the supplementary groups of the jobs
+	Groups []uint32 `json:"groups"`
+}
+
+// root returns true when the account has the privileges of the root user or group
+func (a Account) root() bool {
+	if a.UID == 0 || a.GID == 0 {
+		return true
+	}
+	for _, g := range a.Groups {
+		if g == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RunAsConfig maps the users to the account their jobs run as. A user mapping overrides the mappings of its roles,
+// the first of its roles with a mapping is used otherwise, and the default account when none has one.
+type RunAsConfig struct {
+	// Enabled runs the jobs as the mapped accounts, they run as the user of the server when disabled
+	Enabled bool               `json:"enabled"`
+	Users   map[string]Account `json:"users"`
+	Roles   map[string]Account `json:"roles"`
+	Default Account            `json:"default"`
+	// AllowRootForAdmins lets admins run jobs as root when they are mapped to it, jobs mapped to root are refused otherwise
+	AllowRootForAdmins bool `json:"allow_root_for_admins"`
+}
+
+// credentialFor returns the account the jobs of the user run as, nil when the jobs run as the user of the server.
+func (c RunAsConfig) credentialFor(user *User) (*worker.Credential, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	account, ok := c.Users[user.Name]
+	for _, role := range user.Roles {
+		if ok {
+			break
+		}
+		account, ok = c.Roles[role]
+	}
+	if !ok {
+		account = c.Default
+	}
+	if account.root() && !(c.AllowRootForAdmins && contains("admin", user.Roles)) {
+		return nil, errors.New("jobs cannot run as root")
+	}
+	return &worker.Credential{UID: account.UID, GID: account.GID, Groups: account.Groups}, nil
+}
+
+// allowsInheritEnv verifies a user with the roles can start jobs with the environment of the server
+func (p ExecPolicy) allowsInheritEnv(roles []string) bool {
+	for _, role := range roles {
+		if contains(role, p.InheritEnvRoles) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWorkingDir verifies the directory exists and is allowed by the policy once its symbolic links are resolved,
+// it returns the resolved directory so that the job runs in the directory that was checked.
+func (p ExecPolicy) checkWorkingDir(dir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		return "", fmt.Errorf("working directory must be an absolute path: %q", dir)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("working directory does not exist: %q", dir)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil || !info.IsDir() {
+		return "", fmt.Errorf("working directory is not a directory: %q", dir)
+	}
+	for _, allowed := range p.AllowedWorkingDirs {
+		allowed = filepath.Clean(allowed)
+		if allowed == "/" || resolved == allowed || strings.HasPrefix(resolved, allowed+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("working directory is not allowed: %q", dir)
+}
+
+// validateEnv verifies the variables are given as KEY=VALUE
+func validateEnv(env []string) error {
+	for _, v := range env {
+		if i := strings.Index(v, "="); i <= 0 {
+			return fmt.Errorf("invalid environment variable, expected KEY=VALUE: %q", v)
+		}
+	}
+	return nil
+}
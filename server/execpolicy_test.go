@@ -0,0 +1,86 @@
+package server
+
+import (
+	"github.com/mrinalirao/job-worker/worker"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExecPolicy_CheckWorkingDir(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	assert.NoError(t, err)
+	allowed := filepath.Join(root, "allowed")
+	other := filepath.Join(root, "other")
+	assert.NoError(t, os.MkdirAll(filepath.Join(allowed, "sub"), 0700))
+	assert.NoError(t, os.Mkdir(other, 0700))
+	assert.NoError(t, os.Symlink(other, filepath.Join(allowed, "link")))
+	assert.NoError(t, os.WriteFile(filepath.Join(allowed, "file"), nil, 0600))
+	p := ExecPolicy{AllowedWorkingDirs: []string{allowed}}
+
+	dir, err := p.checkWorkingDir(filepath.Join(allowed, "sub"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(allowed, "sub"), dir)
+	_, err = p.checkWorkingDir(allowed)
+	assert.NoError(t, err)
+
+	for _, dir := range []string{
+		other,
+		allowed + "-sibling",
+		filepath.Join(allowed, "link"),
+		filepath.Join(allowed, "file"),
+		filepath.Join(allowed, "missing"),
+		"allowed/sub",
+	} {
+		_, err := p.checkWorkingDir(dir)
+		assert.Error(t, err, dir)
+	}
+	_, err = ExecPolicy{}.checkWorkingDir(allowed)
+	assert.Error(t, err)
+}
+
+func TestExecPolicy_AllowsInheritEnv(t *testing.T) {
+	p := ExecPolicy{InheritEnvRoles: []string{"admin"}}
+	assert.True(t, p.allowsInheritEnv([]string{"user", "admin"}))
+	assert.False(t, p.allowsInheritEnv([]string{"user"}))
+}
+
+func TestValidateEnv(t *testing.T) {
+	assert.NoError(t, validateEnv([]string{"FOO=bar", "EMPTY="}))
+	assert.Error(t, validateEnv([]string{"=bar"}))
+	assert.Error(t, validateEnv([]string{"FOO"}))
+}
+
+func TestRunAsConfig_CredentialFor(t *testing.T) {
+	cfg := RunAsConfig{
+		Enabled: true,
+		Users:   map[string]Account{"alice": {UID: 1001, GID: 1001, Groups: []uint32{100}}, "root": {}},
+		Roles:   map[string]Account{"ci": {UID: 2000, GID: 2000}, "admin": {}},
+		Default: Account{UID: 65534, GID: 65534},
+	}
+	cred, err := cfg.credentialFor(&User{Name: "alice", Roles: []string{"ci"}})
+	assert.NoError(t, err)
+	assert.Equal(t, &worker.Credential{UID: 1001, GID: 1001, Groups: []uint32{100}}, cred)
+	cred, err = cfg.credentialFor(&User{Name: "bob", Roles: []string{"user", "ci"}})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2000), cred.UID)
+	cred, err = cfg.credentialFor(&User{Name: "carol", Roles: []string{"user"}})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(65534), cred.UID)
+
+	_, err = cfg.credentialFor(&User{Name: "root", Roles: []string{"user"}})
+	assert.Error(t, err)
+	_, err = cfg.credentialFor(&User{Name: "dave", Roles: []string{"admin"}})
+	assert.Error(t, err)
+	cfg.AllowRootForAdmins = true
+	cred, err = cfg.credentialFor(&User{Name: "dave", Roles: []string{"admin"}})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), cred.UID)
+	_, err = cfg.credentialFor(&User{Name: "root", Roles: []string{"user"}})
+	assert.Error(t, err)
+
+	cred, err = RunAsConfig{}.credentialFor(&User{Name: "alice"})
+	assert.NoError(t, err)
+	assert.Nil(t, cred)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"github.com/mrinalirao/job-worker/proto"
+	gproto "google.golang.org/protobuf/proto"
+	"sync"
+	"time"
+)
+
+// ErrIdempotencyKeyReused is returned when a key is sent again with a different request
+var ErrIdempotencyKeyReused = errors.New("idempotency key reused with a different request")
+
+type idempotencyEntry struct {
+	user    string
+	key     string
+	jobID   string
+	request *proto.StartJobRequest
+	expires time.Time
+	// done is closed once the start of the job returned, the entry is removed when it failed
+	done chan struct{}
+}
+
+// IdempotencyKeys remembers the job started for each idempotency key of a user during the window,
+// so that a retried StartJob returns the job started by the first request instead of starting a new one.
+type IdempotencyKeys struct {
+	window time.Duration
+	keys   map[string]map[string]*idempotencyEntry
+	// started holds the started entries in expiry order
+	started []*idempotencyEntry
+	now     func() time.Time
+	sync.Mutex
+}
+
+func NewIdempotencyKeys(window time.Duration) *IdempotencyKeys {
+	return &IdempotencyKeys{
+		window: window,
+		keys:   make(map[string]map[string]*idempotencyEntry),
+		now:    time.Now,
+	}
+}
+
+// Start returns the job started for the key of the user during the window, else it starts the job with start and remembers it.
+// Requests with the same key are serialized so that concurrent retries start a single job, failed starts are not remembered.
+// Requests with other keys are started concurrently.
+func (k *IdempotencyKeys) Start(user string, key string, r *proto.StartJobRequest, start func() (string, error)) (string, error) {
+	k.Lock()
+	k.prune()
+	for {
+		entry, ok := k.keys[user][key]
+		if !ok {
+			break
+		}
+		if !gproto.Equal(entry.request, r) {
+			k.Unlock()
+			return "", ErrIdempotencyKeyReused
+		}
+		select {
+		case <-entry.done:
+			k.Unlock()
+			return entry.jobID, nil
+		default:
+		}
+		// wait for the concurrent request with the key, its entry is removed when its start failed
+		k.Unlock()
+		<-entry.done
+		k.Lock()
+	}
+
+	entry := &idempotencyEntry{
+		user:    user,
+		key:     key,
+		request: gproto.Clone(r).(*proto.StartJobRequest),
+		done:    make(chan struct{}),
+	}
+	if k.keys[user] == nil {
+		k.keys[user] = make(map[string]*idempotencyEntry)
+	}
+	k.keys[user][key] = entry
+	k.Unlock()
+
+	jobID, err := start()
+
+	k.Lock()
+	defer k.Unlock()
+	if err != nil {
+		k.remove(entry)
+	} else {
+		entry.jobID = jobID
+		entry.expires = k.now().Add(k.window)
+		k.started = append(k.started, entry)
+	}
+	close(entry.done)
+	return jobID, err
+}
+
+// prune removes the expired entries of all the users, the caller must hold the lock
+func (k *IdempotencyKeys) prune() {
+	now := k.now()
+	for len(k.started) > 0 && !now.Before(k.started[0].expires) {
+		k.remove(k.started[0])
+		k.started = k.started[1:]
+	}
+}
+
+// remove removes the entry unless it was replaced, the caller must hold the lock
+func (k *IdempotencyKeys) remove(entry *idempotencyEntry) {
+	keys := k.keys[entry.user]
+	if keys[entry.key] != entry {
+		return
+	}
+	delete(keys, entry.key)
+	if len(keys) == 0 {
+		delete(k.keys, entry.user)
+	}
+}
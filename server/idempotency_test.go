@@ -0,0 +1,101 @@
+package server
+
+import (
+	"errors"
+	"github.com/mrinalirao/job-worker/proto"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeys_Start(t *testing.T) {
+	k := NewIdempotencyKeys(time.Hour)
+	now := time.Now()
+	k.now = func() time.Time { return now }
+	started := 0
+	start := func() (string, error) {
+		started++
+		return strconv.Itoa(started), nil
+	}
+	r := &proto.StartJobRequest{Cmd: "echo", Args: []string{"foo"}}
+
+	jobID, err := k.Start("alice", "key", r, start)
+	assert.NoError(t, err)
+	retried, err := k.Start("alice", "key", &proto.StartJobRequest{Cmd: "echo", Args: []string{"foo"}}, start)
+	assert.NoError(t, err)
+	assert.Equal(t, jobID, retried)
+	assert.Equal(t, 1, started)
+
+	// keys are scoped per user
+	other, err := k.Start("bob", "key", r, start)
+	assert.NoError(t, err)
+	assert.NotEqual(t, jobID, other)
+
+	_, err = k.Start("alice", "key", &proto.StartJobRequest{Cmd: "echo", Args: []string{"bar"}}, start)
+	assert.ErrorIs(t, err, ErrIdempotencyKeyReused)
+
+	now = now.Add(time.Hour)
+	expired, err := k.Start("alice", "key", r, start)
+	assert.NoError(t, err)
+	assert.NotEqual(t, jobID, expired)
+}
+
+func TestIdempotencyKeys_Concurrent(t *testing.T) {
+	k := NewIdempotencyKeys(time.Hour)
+	r := &proto.StartJobRequest{Cmd: "echo"}
+	release := make(chan struct{})
+	blocked := make(chan struct{})
+	go func() {
+		k.Start("alice", "slow", r, func() (string, error) {
+			close(blocked)
+			<-release
+			return "slow", nil
+		})
+	}()
+	<-blocked
+
+	// other keys are not blocked by the pending start
+	jobID, err := k.Start("alice", "other", r, func() (string, error) { return "other", nil })
+	assert.NoError(t, err)
+	assert.Equal(t, "other", jobID)
+
+	// the same key waits for the pending start
+	retried := make(chan string)
+	go func() {
+		jobID, _ := k.Start("alice", "slow", r, func() (string, error) { return "duplicate", nil })
+		retried <- jobID
+	}()
+	select {
+	case <-retried:
+		t.Fatal("retry returned before the first start")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	assert.Equal(t, "slow", <-retried)
+}
+
+func TestIdempotencyKeys_FailedStart(t *testing.T) {
+	k := NewIdempotencyKeys(time.Hour)
+	r := &proto.StartJobRequest{Cmd: "echo"}
+	_, err := k.Start("alice", "key", r, func() (string, error) { return "", errors.New("failed") })
+	assert.Error(t, err)
+	jobID, err := k.Start("alice", "key", r, func() (string, error) { return "job", nil })
+	assert.NoError(t, err)
+	assert.Equal(t, "job", jobID)
+}
+
+func TestIdempotencyKeys_PruneAllUsers(t *testing.T) {
+	k := NewIdempotencyKeys(time.Minute)
+	now := time.Now()
+	k.now = func() time.Time { return now }
+	r := &proto.StartJobRequest{Cmd: "echo"}
+	_, err := k.Start("alice", "key", r, func() (string, error) { return "alice", nil })
+	assert.NoError(t, err)
+
+	now = now.Add(time.Minute)
+	_, err = k.Start("bob", "key", r, func() (string, error) { return "bob", nil })
+	assert.NoError(t, err)
+	assert.NotContains(t, k.keys, "alice")
+	assert.Len(t, k.started, 1)
+}
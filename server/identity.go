@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Identity sources supported in IdentityConfig.Sources
+const (
+	sourceURI        = "uri"
+	sourceEmail      = "email"
+	sourceCommonName = "cn"
+)
+
+// IdentityConfig configures how the user identity is extracted from the client certificate.
+type IdentityConfig struct {
+	// Sources lists the certificate fields used to identify the user, in order of preference.
+	// Supported values are "uri" (URI SAN), "email" (email SAN) and "cn" (subject common name).
+	Sources []string `json:"sources"`
+	// URIPrefix is required on URI SANs and stripped from the identity, eg: "spiffe://example.org/user/"
+	URIPrefix string `json:"uri_prefix"`
+	// GroupRoles maps the certificate organizational units (groups) to the roles granted to their members.
+	GroupRoles map[string][]string `json:"group_roles"`
+}
+
+// IdentityExtractor returns the user identity found in the certificate, or an empty string if there is none.
+type IdentityExtractor func(cert *x509.Certificate) string
+
+// identityResolver builds the User of a request from its client certificate
+type identityResolver struct {
+	extractors []IdentityExtractor
+	groupRoles map[string][]string
+}
+
+func newIdentityResolver(cfg IdentityConfig) (*identityResolver, error) {
+	if len(cfg.Sources) == 0 {
+		return nil, errors.New("no identity source configured")
+	}
+	r := &identityResolver{groupRoles: cfg.GroupRoles}
+	for _, source := range cfg.Sources {
+		switch source {
+		case sourceURI:
+			r.extractors = append(r.extractors, uriIdentity(cfg.URIPrefix))
+		case sourceEmail:
+			r.extractors = append(r.extractors, emailIdentity)
+		case sourceCommonName:
+			r.extractors = append(r.extractors, commonNameIdentity)
+		default:
+			return nil, fmt.Errorf("unknown identity source: %q", source)
+		}
+	}
+	return r, nil
+}
+
+// Resolve returns the user identified by the certificate along with its roles and groups.
+// Roles are read from the certificate extension oid 1.2.840.10070.8.1 and from the configured group mapping.
+func (r *identityResolver) Resolve(cert *x509.Certificate) (*User, error) {
+	user := &User{
+		Groups: cert.Subject.OrganizationalUnit,
+	}
+	for _, extract := range r.extractors {
+		if name := extract(cert); name != "" {
+			user.Name = name
+			break
+		}
+	}
+	if user.Name == "" {
+		return nil, errors.New("no identity found in certificate")
+	}
+
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidRole) {
+			user.Roles = appendUnique(user.Roles, ParseRoles(string(ext.Value))...)
+			break
+		}
+	}
+	for _, group := range user.Groups {
+		user.Roles = appendUnique(user.Roles, r.groupRoles[group]...)
+	}
+	return user, nil
+}
+
+func uriIdentity(prefix string) IdentityExtractor {
+	return func(cert *x509.Certificate) string {
+		for _, uri := range cert.URIs {
+			if s := uri.String(); strings.HasPrefix(s, prefix) {
+				return strings.TrimPrefix(s, prefix)
+			}
+		}
+		return ""
+	}
+}
+
+func emailIdentity(cert *x509.Certificate) string {
+	if len(cert.EmailAddresses) == 0 {
+		return ""
+	}
+	return cert.EmailAddresses[0]
+}
+
+func commonNameIdentity(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
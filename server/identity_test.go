@@ -0,0 +1,68 @@
+package server
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+)
+
+func testCert(t *testing.T) *x509.Certificate {
+	uri, err := url.Parse("spiffe://example.org/user/alice")
+	assert.NoError(t, err)
+	return &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "alice-cn",
+			OrganizationalUnit: []string{"platform"},
+		},
+		URIs:           []*url.URL{uri},
+		EmailAddresses: []string{"alice@example.org"},
+		Extensions: []pkix.Extension{
+			{Id: oidRole, Value: []byte("user")},
+		},
+	}
+}
+
+func TestIdentityResolver_Sources(t *testing.T) {
+	cert := testCert(t)
+	tests := []struct {
+		sources []string
+		want    string
+	}{
+		{[]string{sourceCommonName}, "alice-cn"},
+		{[]string{sourceEmail, sourceCommonName}, "alice@example.org"},
+		{[]string{sourceURI}, "alice"},
+	}
+	for _, tt := range tests {
+		r, err := newIdentityResolver(IdentityConfig{Sources: tt.sources, URIPrefix: "spiffe://example.org/user/"})
+		assert.NoError(t, err)
+		user, err := r.Resolve(cert)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, user.Name)
+	}
+}
+
+func TestIdentityResolver_URIPrefixMismatch(t *testing.T) {
+	r, err := newIdentityResolver(IdentityConfig{Sources: []string{sourceURI}, URIPrefix: "spiffe://other.org/"})
+	assert.NoError(t, err)
+	_, err = r.Resolve(testCert(t))
+	assert.Error(t, err)
+}
+
+func TestIdentityResolver_GroupRoles(t *testing.T) {
+	r, err := newIdentityResolver(IdentityConfig{
+		Sources:    []string{sourceCommonName},
+		GroupRoles: map[string][]string{"platform": {"admin", "user"}},
+	})
+	assert.NoError(t, err)
+	user, err := r.Resolve(testCert(t))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"platform"}, user.Groups)
+	assert.Equal(t, []string{"user", "admin"}, user.Roles)
+}
+
+func TestIdentityResolver_UnknownSource(t *testing.T) {
+	_, err := newIdentityResolver(IdentityConfig{Sources: []string{"dns"}})
+	assert.Error(t, err)
+}
@@ -3,44 +3,73 @@ package server
 import (
 	"context"
 	"errors"
+	"fmt"
+	"github.com/google/uuid"
 	"github.com/mrinalirao/job-worker/proto"
 	"github.com/mrinalirao/job-worker/store"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"strings"
 )
 
 type interceptor struct {
 	jobUserStore store.JobUserStore
+	shareTokens  *ShareTokenSigner
+	auditLog     *AuditLog
+	identity     *identityResolver
+	groupAccess  string
 }
 
-func NewInterceptor(store store.JobUserStore) *interceptor {
+func NewInterceptor(store store.JobUserStore, shareTokens *ShareTokenSigner, auditLog *AuditLog, cfg Config) (*interceptor, error) {
+	identity, err := newIdentityResolver(cfg.Identity)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.GroupAccess {
+	case groupAccessNone, groupAccessRead, groupAccessControl:
+	default:
+		return nil, fmt.Errorf("unknown group access: %q", cfg.GroupAccess)
+	}
 	return &interceptor{
 		jobUserStore: store,
-	}
+		shareTokens:  shareTokens,
+		auditLog:     auditLog,
+		identity:     identity,
+		groupAccess:  cfg.GroupAccess,
+	}, nil
 }
 
 // UnaryAuthInterceptor intercept unary calls to authorize the user
-// It checks user role using certification extension oid 1.2.840.10070.8.1, it also checks if user has access to the requested resource
+// It identifies the user and its roles from the client certificate, it also checks if user has access to the requested resource
+// The decision and the outcome of the call are recorded in the audit log
 func (i *interceptor) UnaryAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	i.resolveJobName(ctx, req)
 	jobID := jobIdFromRequest(req)
-	roles, err := i.authorize(ctx, info.FullMethod)
+	rec := newAuditRecord(info.FullMethod, req)
+	newCtx, err := i.authorizeRequest(ctx, info.FullMethod, jobID)
+	i.auditDecision(newCtx, &rec, err)
 	if err != nil {
-		return nil, status.Error(codes.PermissionDenied, err.Error())
-	}
-	newCtx, err := i.verifyAuthenticatedUser(ctx, jobID, roles)
-	if err != nil {
-		return nil, status.Error(codes.PermissionDenied, err.Error())
+		err = status.Error(codes.PermissionDenied, err.Error())
+		i.audit(rec, nil, err)
+		return nil, err
 	}
-	return handler(newCtx, req)
+	resp, err := handler(newCtx, req)
+	i.audit(rec, resp, err)
+	return resp, err
 }
 
 type recvWrapper struct {
 	grpc.ServerStream
-	ctx context.Context
+	ctx    context.Context
+	method string
+	rec    *AuditRecord
+	// authorized is set once the first message of the stream was authorized
+	authorized bool
 	*interceptor
 }
 
@@ -53,26 +82,100 @@ func (r *recvWrapper) RecvMsg(m interface{}) error {
 		logrus.Errorf("failed to intercept stream: %v", err)
 		return err
 	}
-	if req, ok := m.(*proto.GetStreamRequest); ok {
-		jobID := req.GetId()
-		roles, err := r.authorize(r.ctx, "/proto.WorkerService/GetOutputStream")
-		if err != nil {
-			return err
-		}
-		newCtx, err := r.verifyAuthenticatedUser(r.ctx, jobID, roles)
-		if err != nil {
-			return err
-		}
-		r.ctx = newCtx
+	// the first message addresses the job of the stream
+	if r.authorized {
+		return nil
+	}
+	r.resolveJobName(r.ctx, m)
+	r.rec.JobID = jobIdFromRequest(m)
+	r.rec.Cmd, r.rec.Args = commandFromRequest(m)
+	newCtx, err := r.authorizeRequest(r.ctx, r.method, r.rec.JobID)
+	r.auditDecision(newCtx, r.rec, err)
+	if err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
 	}
+	r.ctx = newCtx
+	r.authorized = true
 	return nil
 }
 
 // StreamAuthInterceptor intercept stream calls to authorize the user
-// It checks the user role using certification extension oid 1.2.840.10070.8.1, it also checks if user has access to the requested resource
+// It identifies the user and its roles from the client certificate, it also checks if user has access to the requested resource
 func (i *interceptor) StreamAuthInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-	wrapper := &recvWrapper{stream, stream.Context(), i}
-	return handler(srv, wrapper)
+	rec := newAuditRecord(info.FullMethod, nil)
+	wrapper := &recvWrapper{ServerStream: stream, ctx: stream.Context(), method: info.FullMethod, rec: &rec, interceptor: i}
+	err := handler(srv, wrapper)
+	if rec.Decision == "" {
+		rec.Decision = decisionDenied
+		rec.Reason = "no request received"
+	}
+	i.audit(rec, nil, err)
+	return err
+}
+
+// newAuditRecord returns the audit record of a request before it is authorized
+func newAuditRecord(method string, req interface{}) AuditRecord {
+	rec := AuditRecord{
+		Method: method,
+		JobID:  jobIdFromRequest(req),
+	}
+	rec.Cmd, rec.Args = commandFromRequest(req)
+	return rec
+}
+
+// commandFromRequest returns the command and arguments run by the request, if any
+func commandFromRequest(req interface{}) (string, []string) {
+	switch r := req.(type) {
+	case *proto.StartJobRequest:
+		return r.GetCmd(), r.GetArgs()
+	case *proto.CreateScheduleRequest:
+		return r.GetJob().GetCmd(), r.GetJob().GetArgs()
+	case *proto.StartBatchRequest:
+		return r.GetJob().GetCmd(), r.GetJob().GetArgs()
+	case *proto.ExecRequest:
+		return r.GetCmd(), r.GetArgs()
+	}
+	return "", nil
+}
+
+// auditDecision adds the authorization decision and the caller identity to the audit record
+func (i *interceptor) auditDecision(ctx context.Context, rec *AuditRecord, err error) {
+	user, ok := UserFromContext(ctx)
+	if !ok {
+		// the identity of denied callers is still recorded when their certificate is valid
+		user, _ = i.authenticate(ctx)
+	}
+	if user != nil {
+		rec.User = user.Name
+		rec.Roles = user.Roles
+	}
+	switch {
+	case err != nil:
+		rec.Decision = decisionDenied
+		rec.Reason = err.Error()
+	case user != nil && user.ShareToken:
+		rec.Decision = decisionAllowed
+		rec.Reason = "share token"
+	default:
+		rec.Decision = decisionAllowed
+	}
+}
+
+// audit records the outcome of the call in the audit log
+func (i *interceptor) audit(rec AuditRecord, resp interface{}, err error) {
+	switch r := resp.(type) {
+	case *proto.StartJobResponse:
+		rec.JobID = r.GetID()
+	case *proto.StartWorkflowResponse:
+		rec.JobID = r.GetId()
+	case *proto.StartBatchResponse:
+		rec.JobID = r.GetId()
+	}
+	rec.Outcome = status.Code(err).String()
+	if err != nil {
+		rec.Error = status.Convert(err).Message()
+	}
+	i.auditLog.Record(rec)
 }
 
 func tlsInfo(ctx context.Context) (*credentials.TLSInfo, error) {
@@ -89,60 +192,83 @@ func tlsInfo(ctx context.Context) (*credentials.TLSInfo, error) {
 	return &info, nil
 }
 
-// authorize verifies the user information given by certificate
-// against the mapped roles for a specific method
-func (i *interceptor) authorize(ctx context.Context, method string) ([]string, error) {
+// authorizeRequest authorizes the user to call the method on the job and returns the context holding the user.
+// The job status and output stream can alternatively be authorized by a share token for the job passed in the request metadata.
+func (i *interceptor) authorizeRequest(ctx context.Context, method string, jobID string) (context.Context, error) {
+	if token := shareTokenFromContext(ctx); token != "" && jobID != "" && shareTokenMethods[method] {
+		if err := i.shareTokens.Verify(token, jobID); err != nil {
+			return ctx, err
+		}
+		user, err := i.authenticate(ctx)
+		if err != nil {
+			return ctx, err
+		}
+		user.ShareToken = true
+		return context.WithValue(ctx, userKey{}, user), nil
+	}
+	user, err := i.authorize(ctx, method)
+	if err != nil {
+		return ctx, err
+	}
+	return i.verifyAuthenticatedUser(ctx, method, jobID, user)
+}
+
+// shareTokenFromContext returns the share token passed in the incoming metadata, if any
+func shareTokenFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(shareTokenHeader); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// authenticate returns the user identified by the client certificate
+func (i *interceptor) authenticate(ctx context.Context) (*User, error) {
+	return peerUser(ctx, i.identity)
+}
+
+// peerUser resolves the user from the verified client certificate of the peer
+func peerUser(ctx context.Context, identity *identityResolver) (*User, error) {
 	ti, err := tlsInfo(ctx)
 	if err != nil {
 		return nil, err
 	}
-	// get user roles
 	certs := ti.State.VerifiedChains
 	if len(certs) == 0 || len(certs[0]) == 0 {
 		return nil, errors.New("missing certificate chain")
 	}
+	return identity.Resolve(certs[0][0])
+}
 
-	// find user roles from certificate extensions
-	var roles []string
-	for _, ext := range certs[0][0].Extensions {
-		if ext.Id.Equal(oidRole) {
-			roles = ParseRoles(string(ext.Value))
-			break
-		}
+// authorize verifies the user information given by certificate
+// against the mapped roles for a specific method
+func (i *interceptor) authorize(ctx context.Context, method string) (*User, error) {
+	user, err := i.authenticate(ctx)
+	if err != nil {
+		return nil, err
 	}
 	// check user has access to execute a specific method
-	if !HasAccess(method, roles) {
+	if !HasAccess(method, user.Roles) {
 		return nil, errors.New("unauthorized, user does not have privileges")
 	}
-	return roles, nil
+	return user, nil
 }
 
-// verifyAuthenticatedUser checks if the user can access to the resource
-func (i *interceptor) verifyAuthenticatedUser(ctx context.Context, jobID string, roles []string) (context.Context, error) {
-	ti, err := tlsInfo(ctx)
-	if err != nil {
-		return ctx, err
-	}
-
-	certs := ti.State.VerifiedChains
-	if len(certs) == 0 || len(certs[0]) == 0 {
-		return ctx, errors.New("missing certificate chain")
-	}
-	// Get subject common name
-	userName := certs[0][0].Subject.CommonName
-
-	if jobID != "" && !contains("admin", roles) {
-		u, err := i.jobUserStore.GetUser(jobID)
+// verifyAuthenticatedUser checks if the user can access to the resource, see canAccessJob.
+func (i *interceptor) verifyAuthenticatedUser(ctx context.Context, method string, jobID string, user *User) (context.Context, error) {
+	if jobID != "" && (ownerOnly[method] || !contains("admin", user.Roles)) {
+		owner, err := i.jobUserStore.GetOwner(jobID)
 		if err != nil {
 			return ctx, errors.New("failed to verify user access to job")
 		}
-		if u != userName {
+		if !canAccessJob(user, owner, i.groupAccess, method) {
 			return ctx, errors.New("no does not have access to this job")
 		}
 	}
-	return context.WithValue(ctx, userKey{}, &User{
-		Name: userName,
-	}), nil
+	return context.WithValue(ctx, userKey{}, user), nil
 }
 
 // jobIdFromRequest returns the jobID from the request
@@ -152,7 +278,73 @@ func jobIdFromRequest(req interface{}) string {
 		return r.GetId()
 	case *proto.GetStatusRequest:
 		return r.GetId()
+	case *proto.CreateShareTokenRequest:
+		return r.GetId()
+	case *proto.GetWorkflowStatusRequest:
+		return r.GetId()
+	case *proto.StopWorkflowRequest:
+		return r.GetId()
+	case *proto.GetBatchStatusRequest:
+		return r.GetId()
+	case *proto.StopBatchRequest:
+		return r.GetId()
+	case *proto.GetStreamRequest:
+		return r.GetId()
+	case *proto.WriteStdinRequest:
+		return r.GetId()
+	case *proto.AttachRequest:
+		return r.GetId()
+	case *proto.ExecRequest:
+		return r.GetId()
 	default:
 	}
 	return ""
 }
+
+// jobIdField returns the job ID field of the requests addressing a single job, nil for other requests
+func jobIdField(req interface{}) *string {
+	switch r := req.(type) {
+	case *proto.StopJobRequest:
+		return &r.Id
+	case *proto.GetStatusRequest:
+		return &r.Id
+	case *proto.CreateShareTokenRequest:
+		return &r.Id
+	case *proto.GetStreamRequest:
+		return &r.Id
+	case *proto.WriteStdinRequest:
+		return &r.Id
+	case *proto.AttachRequest:
+		return &r.Id
+	case *proto.ExecRequest:
+		return &r.Id
+	}
+	return nil
+}
+
+// resolveJobName replaces the job name given in place of the job ID of the request by the ID of the job.
+// A name is resolved among the jobs of the caller, "<user>/<name>" resolves the job of another user which must still
+// give access to the job. Unknown names are left as is and fail like unknown IDs.
+func (i *interceptor) resolveJobName(ctx context.Context, req interface{}) {
+	id := jobIdField(req)
+	if id == nil || *id == "" {
+		return
+	}
+	if _, err := uuid.Parse(*id); err == nil {
+		return
+	}
+	name := *id
+	var owner string
+	if k := strings.Index(name, "/"); k >= 0 {
+		owner, name = name[:k], name[k+1:]
+	} else {
+		user, err := i.authenticate(ctx)
+		if err != nil {
+			return
+		}
+		owner = user.Name
+	}
+	if jobID, err := i.jobUserStore.GetJobByName(owner, name); err == nil {
+		*id = jobID
+	}
+}
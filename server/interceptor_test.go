@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/mrinalirao/job-worker/store"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"testing"
+)
+
+func TestInterceptor_AuthorizeRequest_ShareToken(t *testing.T) {
+	cfg := DefaultConfig()
+	shareTokens, err := NewShareTokenSigner(cfg.ShareTokens)
+	assert.NoError(t, err)
+	jobs := store.NewJobStore()
+	assert.NoError(t, jobs.SetJobOwner("job", store.Owner{User: "bob"}))
+	i, err := NewInterceptor(jobs, shareTokens, nil, cfg)
+	assert.NoError(t, err)
+
+	token, _, err := shareTokens.Issue("job", 0)
+	assert.NoError(t, err)
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{
+		State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{testCert(t)}}},
+	}})
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(shareTokenHeader, token))
+
+	for _, method := range []string{"/proto.WorkerService/GetJobStatus", "/proto.WorkerService/GetOutputStream"} {
+		newCtx, err := i.authorizeRequest(ctx, method, "job")
+		assert.NoError(t, err, method)
+		user, ok := UserFromContext(newCtx)
+		assert.True(t, ok)
+		assert.True(t, user.ShareToken)
+	}
+	// the token does not open interactive sessions nor control the job
+	for _, method := range []string{"/proto.WorkerService/AttachJob", "/proto.WorkerService/StopJob"} {
+		_, err := i.authorizeRequest(ctx, method, "job")
+		assert.Error(t, err, method)
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/mrinalirao/job-worker/worker"
+	"regexp"
+	"strings"
+)
+
+// labelPattern matches the job names and the label keys and values: alphanumeric characters, '-', '_' and '.' up to 63 characters,
+// starting and ending with an alphanumeric character
+var labelPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._-]{0,61}[a-zA-Z0-9])?$`)
+
+// validateJobName verifies the name can be used in place of a job ID
+func validateJobName(name string) error {
+	if !labelPattern.MatchString(name) {
+		return fmt.Errorf("invalid job name: %q", name)
+	}
+	if _, err := uuid.Parse(name); err == nil {
+		return fmt.Errorf("job name must not be a UUID: %q", name)
+	}
+	return nil
+}
+
+// validateLabels verifies the label keys and values, values can be empty
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !labelPattern.MatchString(key) {
+			return fmt.Errorf("invalid label key: %q", key)
+		}
+		if value != "" && !labelPattern.MatchString(value) {
+			return fmt.Errorf("invalid label value: %q", value)
+		}
+	}
+	return nil
+}
+
+// Operators of a label requirement
+const (
+	labelEquals    = "="
+	labelNotEquals = "!="
+	labelExists    = "exists"
+	labelNotExists = "!exists"
+)
+
+type labelRequirement struct {
+	key   string
+	op    string
+	value string
+}
+
+// LabelSelector selects jobs by their labels, a job matches when it meets all the requirements
+type LabelSelector []labelRequirement
+
+// ParseLabelSelector parses a comma separated list of requirements: "key=value" (or "key==value"), "key!=value",
+// "key" (the label is set) and "!key" (the label is not set). The empty selector matches all jobs.
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	var s LabelSelector
+	if strings.TrimSpace(selector) == "" {
+		return s, nil
+	}
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		var req labelRequirement
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			req = labelRequirement{key: kv[0], op: labelNotEquals, value: kv[1]}
+		case strings.Contains(part, "=="):
+			kv := strings.SplitN(part, "==", 2)
+			req = labelRequirement{key: kv[0], op: labelEquals, value: kv[1]}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			req = labelRequirement{key: kv[0], op: labelEquals, value: kv[1]}
+		case strings.HasPrefix(part, "!"):
+			req = labelRequirement{key: part[1:], op: labelNotExists}
+		default:
+			req = labelRequirement{key: part, op: labelExists}
+		}
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if !labelPattern.MatchString(req.key) || (req.value != "" && !labelPattern.MatchString(req.value)) {
+			return nil, fmt.Errorf("invalid label selector: %q", part)
+		}
+		s = append(s, req)
+	}
+	return s, nil
+}
+
+// Matches returns true when the labels meet all the requirements of the selector
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, req := range s {
+		value, ok := labels[req.key]
+		switch req.op {
+		case labelEquals:
+			if !ok || value != req.value {
+				return false
+			}
+		case labelNotEquals:
+			if ok && value == req.value {
+				return false
+			}
+		case labelExists:
+			if !ok {
+				return false
+			}
+		case labelNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// JobSelector selects jobs by their owner, labels, status and command, empty criteria match all jobs
+type JobSelector struct {
+	Owner    string
+	Labels   LabelSelector
+	Statuses []worker.StatusEnum
+	Cmd      string
+}
+
+// Empty returns true when the selector has no criteria
+func (s JobSelector) Empty() bool {
+	return s.Owner == "" && len(s.Labels) == 0 && len(s.Statuses) == 0 && s.Cmd == ""
+}
+
+// Matches returns true when the job meets all the criteria of the selector
+func (s JobSelector) Matches(job worker.JobInfo) bool {
+	if s.Owner != "" && job.Spec.Owner != s.Owner {
+		return false
+	}
+	if s.Cmd != "" && job.Spec.Cmd != s.Cmd {
+		return false
+	}
+	if len(s.Statuses) > 0 {
+		found := false
+		for _, stat := range s.Statuses {
+			found = found || stat == job.JobStatus
+		}
+		if !found {
+			return false
+		}
+	}
+	return s.Labels.Matches(job.Spec.Labels)
+}
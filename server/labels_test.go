@@ -0,0 +1,63 @@
+package server
+
+import (
+	"github.com/mrinalirao/job-worker/worker"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLabelSelector_Matches(t *testing.T) {
+	labels := map[string]string{"team": "ci", "env": "prod"}
+	tests := []struct {
+		selector string
+		match    bool
+	}{
+		{"", true},
+		{"team=ci", true},
+		{"team==ci,env=prod", true},
+		{"team=ci,env=dev", false},
+		{"env!=dev", true},
+		{"env!=prod", false},
+		{"owner!=alice", true},
+		{"team", true},
+		{"owner", false},
+		{"!owner", true},
+		{"!team", false},
+	}
+	for _, tt := range tests {
+		s, err := ParseLabelSelector(tt.selector)
+		assert.NoError(t, err, tt.selector)
+		assert.Equal(t, tt.match, s.Matches(labels), tt.selector)
+	}
+}
+
+func TestParseLabelSelector_Invalid(t *testing.T) {
+	for _, selector := range []string{"=ci", "team=c i", "team=ci,", "!"} {
+		_, err := ParseLabelSelector(selector)
+		assert.Error(t, err, selector)
+	}
+}
+
+func TestValidateJobName(t *testing.T) {
+	assert.NoError(t, validateJobName("nightly-build.1"))
+	assert.Error(t, validateJobName(""))
+	assert.Error(t, validateJobName("alice/build"))
+	assert.Error(t, validateJobName("5f0c2c8e-8f3c-4b43-9a4e-3b8b2c6e7f10"))
+}
+
+func TestJobSelector_Matches(t *testing.T) {
+	labels, err := ParseLabelSelector("team=ci")
+	assert.NoError(t, err)
+	job := worker.JobInfo{
+		Spec:   worker.JobSpec{Cmd: "sleep", Owner: "alice", Labels: map[string]string{"team": "ci"}},
+		Status: worker.Status{JobStatus: worker.Pending},
+	}
+	assert.True(t, JobSelector{}.Matches(job))
+	assert.True(t, JobSelector{Owner: "alice", Labels: labels, Cmd: "sleep"}.Matches(job))
+	assert.True(t, JobSelector{Statuses: []worker.StatusEnum{worker.Running, worker.Pending}}.Matches(job))
+	assert.False(t, JobSelector{Statuses: []worker.StatusEnum{worker.Running}}.Matches(job))
+	assert.False(t, JobSelector{Owner: "bob"}.Matches(job))
+	assert.False(t, JobSelector{Cmd: "ls"}.Matches(job))
+	assert.True(t, JobSelector{}.Empty())
+	assert.False(t, JobSelector{Labels: labels}.Empty())
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"fmt"
+	"github.com/mrinalirao/job-worker/worker"
+	"sync"
+	"time"
+)
+
+// Quota limits the jobs of a user, zero values are unlimited.
+type Quota struct {
+	MaxRunningJobs int    `json:"max_running_jobs"`
+	MaxMemoryBytes uint64 `json:"max_memory_bytes"`
+	MaxCPUMillis   uint64 `json:"max_cpu_millis"`
+	MaxJobsPerHour int    `json:"max_jobs_per_hour"`
+}
+
+// QuotaConfig holds the quotas of users. A user quota overrides the quotas of its roles,
+// a user with several roles gets the most permissive limit of each role.
+type QuotaConfig struct {
+	Roles map[string]Quota `json:"roles"`
+	Users map[string]Quota `json:"users"`
+}
+
+// Usage of the resources reserved by the running and queued jobs of a user
+type Usage struct {
+	RunningJobs  int
+	MemoryBytes  uint64
+	CPUMillis    uint64
+	JobsLastHour int
+}
+
+// QuotaError is returned when starting a job would exceed a quota of the user
+type QuotaError struct {
+	Quota string
+	Limit uint64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s (limit %d)", e.Quota, e.Limit)
+}
+
+// reservation holds the resources reserved by a job
+type reservation struct {
+	limits worker.Limits
+	// charged is set when the job was charged while held, it is not counted while waiting otherwise
+	charged bool
+}
+
+// QuotaTracker keeps the resources reserved by the jobs of each user and enforces their quotas.
+type QuotaTracker struct {
+	cfg    QuotaConfig
+	worker worker.Worker
+	// jobs holds the reservations of the jobs of each user which were active at the last check
+	jobs map[string]map[string]reservation
+	// starts holds the start time of the jobs of each user in the last hour
+	starts map[string][]time.Time
+	now    func() time.Time
+	sync.Mutex
+}
+
+func NewQuotaTracker(cfg QuotaConfig, w worker.Worker) *QuotaTracker {
+	return &QuotaTracker{
+		cfg:    cfg,
+		worker: w,
+		jobs:   make(map[string]map[string]reservation),
+		starts: make(map[string][]time.Time),
+		now:    time.Now,
+	}
+}
+
+// QuotaFor returns the quota applying to the user
+func (q *QuotaTracker) QuotaFor(user *User) Quota {
+	if quota, ok := q.cfg.Users[user.Name]; ok {
+		return quota
+	}
+	var quota Quota
+	found := false
+	for _, role := range user.Roles {
+		r, ok := q.cfg.Roles[role]
+		if !ok {
+			continue
+		}
+		if !found {
+			quota, found = r, true
+			continue
+		}
+		quota.MaxRunningJobs = int(maxLimit(uint64(quota.MaxRunningJobs), uint64(r.MaxRunningJobs)))
+		quota.MaxMemoryBytes = maxLimit(quota.MaxMemoryBytes, r.MaxMemoryBytes)
+		quota.MaxCPUMillis = maxLimit(quota.MaxCPUMillis, r.MaxCPUMillis)
+		quota.MaxJobsPerHour = int(maxLimit(uint64(quota.MaxJobsPerHour), uint64(r.MaxJobsPerHour)))
+	}
+	return quota
+}
+
+// Usage returns the resources currently reserved by the jobs of the user
+func (q *QuotaTracker) Usage(user string) Usage {
+	q.Lock()
+	defer q.Unlock()
+	return q.usage(user)
+}
+
+// Reserve starts a job with start if it fits in the quota of the user and records its resources.
+// A QuotaError is returned when a quota would be exceeded.
+func (q *QuotaTracker) Reserve(user *User, limits worker.Limits, start func() (string, error)) (string, error) {
+	q.Lock()
+	defer q.Unlock()
+	limits = limits.WithDefaults()
+	if err := q.check(user, []worker.Limits{limits}, 1); err != nil {
+		return "", err
+	}
+	jobID, err := start()
+	if err != nil {
+		return jobID, err
+	}
+	q.record(user.Name, jobID, reservation{limits: limits, charged: true})
+	return jobID, nil
+}
+
+// ReserveAll starts several jobs at once with start if they fit in the quota of the user and records their resources,
+// start returns the job IDs in the order of the limits.
+// Only the jobs given by their index in admitted are charged against the running jobs, memory and CPU quotas.
+// The other jobs are not checked again when the worker admits them, they must only be admitted as charged jobs end,
+// eg: the batch jobs beyond the parallelism. They count towards the usage once admitted. All the jobs count towards the jobs per hour.
+func (q *QuotaTracker) ReserveAll(user *User, limits []worker.Limits, admitted []int, start func() ([]string, error)) ([]string, error) {
+	q.Lock()
+	defer q.Unlock()
+	for i := range limits {
+		limits[i] = limits[i].WithDefaults()
+	}
+	reservations := make([]reservation, len(limits))
+	charged := make([]worker.Limits, len(admitted))
+	for i, index := range admitted {
+		charged[i] = limits[index]
+		reservations[index].charged = true
+	}
+	if err := q.check(user, charged, len(limits)); err != nil {
+		return nil, err
+	}
+	jobIDs, err := start()
+	if err != nil {
+		return jobIDs, err
+	}
+	for i, jobID := range jobIDs {
+		reservations[i].limits = limits[i]
+		q.record(user.Name, jobID, reservations[i])
+	}
+	return jobIDs, nil
+}
+
+// check returns a QuotaError when running jobs with the limits, out of the number of jobs started, would exceed a quota of the user.
+// The caller must hold the lock.
+func (q *QuotaTracker) check(user *User, limits []worker.Limits, started int) error {
+	quota := q.QuotaFor(user)
+	usage := q.usage(user.Name)
+	var memoryBytes, cpuMillis uint64
+	for _, l := range limits {
+		memoryBytes += l.MemoryBytes
+		cpuMillis += uint64(l.CPUMillis)
+	}
+	switch {
+	case quota.MaxRunningJobs != 0 && usage.RunningJobs+len(limits) > quota.MaxRunningJobs:
+		return &QuotaError{Quota: "max_running_jobs", Limit: uint64(quota.MaxRunningJobs)}
+	case quota.MaxMemoryBytes != 0 && usage.MemoryBytes+memoryBytes > quota.MaxMemoryBytes:
+		return &QuotaError{Quota: "max_memory_bytes", Limit: quota.MaxMemoryBytes}
+	case quota.MaxCPUMillis != 0 && usage.CPUMillis+cpuMillis > quota.MaxCPUMillis:
+		return &QuotaError{Quota: "max_cpu_millis", Limit: quota.MaxCPUMillis}
+	case quota.MaxJobsPerHour != 0 && usage.JobsLastHour+started > quota.MaxJobsPerHour:
+		return &QuotaError{Quota: "max_jobs_per_hour", Limit: uint64(quota.MaxJobsPerHour)}
+	}
+	return nil
+}
+
+// record adds the job to the usage of the user, the caller must hold the lock
+func (q *QuotaTracker) record(user string, jobID string, r reservation) {
+	if q.jobs[user] == nil {
+		q.jobs[user] = make(map[string]reservation)
+	}
+	q.jobs[user][jobID] = r
+	q.starts[user] = append(q.starts[user], q.now())
+}
+
+// usage drops the jobs which are not active anymore and the starts older than an hour before summing up the usage.
+// The running and queued jobs are counted, as well as the held jobs which are admitted without another check:
+// the scheduled jobs and the charged waiting jobs, eg: workflow steps waiting for their dependencies.
+func (q *QuotaTracker) usage(user string) Usage {
+	var usage Usage
+	for jobID, r := range q.jobs[user] {
+		stat, err := q.worker.GetStatus(jobID)
+		if err != nil || stat.JobStatus.Terminal() {
+			delete(q.jobs[user], jobID)
+			continue
+		}
+		switch {
+		case stat.JobStatus == worker.Running, stat.JobStatus == worker.Scheduled, stat.QueuePosition > 0:
+		case stat.JobStatus == worker.Waiting && r.charged:
+		default:
+			// pending jobs backing off before their next attempt are not queued
+			continue
+		}
+		usage.RunningJobs++
+		usage.MemoryBytes += r.limits.MemoryBytes
+		usage.CPUMillis += uint64(r.limits.CPUMillis)
+	}
+
+	hourAgo := q.now().Add(-time.Hour)
+	starts := q.starts[user]
+	for len(starts) > 0 && starts[0].Before(hourAgo) {
+		starts = starts[1:]
+	}
+	q.starts[user] = starts
+	usage.JobsLastHour = len(starts)
+	return usage
+}
+
+// maxLimit returns the most permissive of two limits where 0 is unlimited
+func maxLimit(a, b uint64) uint64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/mrinalirao/job-worker/proto"
+	"github.com/mrinalirao/job-worker/store"
+	"github.com/mrinalirao/job-worker/worker"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"testing"
+)
+
+// statusWorker is a worker.Worker reporting the status of the jobs it holds
+type statusWorker struct {
+	worker.Worker
+	jobs map[string]worker.StatusEnum
+	// queued holds the pending jobs which are queued
+	queued map[string]bool
+}
+
+func (w *statusWorker) GetStatus(jobID string) (worker.Status, error) {
+	stat, ok := w.jobs[jobID]
+	if !ok {
+		return worker.Status{}, errors.New("not found")
+	}
+	if w.queued[jobID] {
+		return worker.Status{JobStatus: stat, QueuePosition: 1}, nil
+	}
+	return worker.Status{JobStatus: stat}, nil
+}
+
+func (w *statusWorker) start() (string, error) {
+	jobID := strconv.Itoa(len(w.jobs))
+	w.jobs[jobID] = worker.Running
+	return jobID, nil
+}
+
+func TestQuotaTracker_MaxRunningJobs(t *testing.T) {
+	w := &statusWorker{jobs: make(map[string]worker.StatusEnum)}
+	q := NewQuotaTracker(QuotaConfig{Roles: map[string]Quota{"user": {MaxRunningJobs: 1}}}, w)
+	user := &User{Name: "alice", Roles: []string{"user"}}
+
+	jobID, err := q.Reserve(user, worker.Limits{}, w.start)
+	assert.NoError(t, err)
+
+	_, err = q.Reserve(user, worker.Limits{}, w.start)
+	var quotaErr *QuotaError
+	assert.True(t, errors.As(err, &quotaErr))
+	assert.Equal(t, "max_running_jobs", quotaErr.Quota)
+
+	w.jobs[jobID] = worker.Finished
+	_, err = q.Reserve(user, worker.Limits{}, w.start)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, q.Usage("alice").RunningJobs)
+	assert.Equal(t, 2, q.Usage("alice").JobsLastHour)
+}
+
+func TestQuotaTracker_MaxMemory(t *testing.T) {
+	w := &statusWorker{jobs: make(map[string]worker.StatusEnum)}
+	q := NewQuotaTracker(QuotaConfig{Users: map[string]Quota{"alice": {MaxMemoryBytes: 100}}}, w)
+	user := &User{Name: "alice"}
+
+	_, err := q.Reserve(user, worker.Limits{MemoryBytes: 60}, w.start)
+	assert.NoError(t, err)
+	_, err = q.Reserve(user, worker.Limits{MemoryBytes: 60}, w.start)
+	assert.Error(t, err)
+}
+
+func TestQuotaTracker_QuotaForRoles(t *testing.T) {
+	q := NewQuotaTracker(QuotaConfig{Roles: map[string]Quota{
+		"user":  {MaxRunningJobs: 2, MaxJobsPerHour: 10},
+		"admin": {MaxRunningJobs: 5},
+	}}, nil)
+	quota := q.QuotaFor(&User{Name: "bob", Roles: []string{"user", "admin"}})
+	assert.Equal(t, 5, quota.MaxRunningJobs)
+	assert.Equal(t, 0, quota.MaxJobsPerHour)
+}
+
+func TestQuotaTracker_ReserveAll(t *testing.T) {
+	w := &statusWorker{jobs: make(map[string]worker.StatusEnum)}
+	q := NewQuotaTracker(QuotaConfig{Roles: map[string]Quota{"user": {MaxRunningJobs: 3}}}, w)
+	user := &User{Name: "alice", Roles: []string{"user"}}
+	startAll := func(n int) func() ([]string, error) {
+		return func() ([]string, error) {
+			var jobIDs []string
+			for i := 0; i < n; i++ {
+				jobID, _ := w.start()
+				jobIDs = append(jobIDs, jobID)
+			}
+			return jobIDs, nil
+		}
+	}
+
+	_, err := q.ReserveAll(user, make([]worker.Limits, 2), []int{0, 1}, startAll(2))
+	assert.NoError(t, err)
+	_, err = q.ReserveAll(user, make([]worker.Limits, 2), []int{0, 1}, startAll(2))
+	var quotaErr *QuotaError
+	assert.True(t, errors.As(err, &quotaErr))
+	assert.Equal(t, 2, q.Usage("alice").RunningJobs)
+
+	// only the jobs admitted right away are charged
+	_, err = q.ReserveAll(user, make([]worker.Limits, 4), []int{0}, startAll(4))
+	assert.NoError(t, err)
+	assert.Equal(t, 6, q.Usage("alice").JobsLastHour)
+}
+
+func TestQuotaTracker_HeldJobs(t *testing.T) {
+	w := &statusWorker{jobs: make(map[string]worker.StatusEnum)}
+	q := NewQuotaTracker(QuotaConfig{Roles: map[string]Quota{"user": {MaxRunningJobs: 1}}}, w)
+	user := &User{Name: "alice", Roles: []string{"user"}}
+
+	// pending jobs which are not queued, eg: backing off before a retry, do not count as running
+	jobID, err := q.Reserve(user, worker.Limits{}, w.start)
+	assert.NoError(t, err)
+	w.jobs[jobID] = worker.Pending
+	assert.Equal(t, 0, q.Usage("alice").RunningJobs)
+
+	// waiting jobs count as running when they were charged
+	jobIDs, err := q.ReserveAll(user, make([]worker.Limits, 2), []int{0}, func() ([]string, error) {
+		var jobIDs []string
+		for i := 0; i < 2; i++ {
+			jobID, _ := w.start()
+			w.jobs[jobID] = worker.Waiting
+			jobIDs = append(jobIDs, jobID)
+		}
+		return jobIDs, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, q.Usage("alice").RunningJobs)
+
+	w.jobs[jobIDs[0]] = worker.Finished
+	w.jobs[jobID] = worker.Pending
+	w.queued = map[string]bool{jobID: true}
+	assert.Equal(t, 1, q.Usage("alice").RunningJobs)
+}
+
+// heldWorker is a statusWorker starting the workflow steps with dependencies and the batch jobs over the parallelism as Waiting
+type heldWorker struct {
+	*statusWorker
+}
+
+func (w heldWorker) StartWorkflow(steps []worker.WorkflowStep) (worker.Workflow, error) {
+	wf := worker.Workflow{ID: "workflow-" + strconv.Itoa(len(w.jobs)), Jobs: make(map[string]string)}
+	for _, step := range steps {
+		jobID, _ := w.start()
+		if len(step.DependsOn) > 0 {
+			w.jobs[jobID] = worker.Waiting
+		}
+		wf.Jobs[step.Name] = jobID
+	}
+	return wf, nil
+}
+
+func (w heldWorker) StartBatch(spec worker.BatchSpec) (worker.Batch, error) {
+	b := worker.Batch{ID: "batch-" + strconv.Itoa(len(w.jobs))}
+	for i := range spec.Params {
+		jobID, _ := w.start()
+		if spec.Parallelism != 0 && i >= spec.Parallelism {
+			w.jobs[jobID] = worker.Waiting
+		}
+		b.Jobs = append(b.Jobs, jobID)
+	}
+	return b, nil
+}
+
+func TestServer_StartBatch_Quota(t *testing.T) {
+	w := heldWorker{&statusWorker{jobs: make(map[string]worker.StatusEnum)}}
+	cfg := DefaultConfig()
+	cfg.Quotas = QuotaConfig{Roles: map[string]Quota{"user": {MaxRunningJobs: 10, MaxMemoryBytes: 1000}}}
+	s := &Server{Config: cfg, Worker: w, UserJobStore: store.NewJobStore(), Quotas: NewQuotaTracker(cfg.Quotas, w)}
+	ctx := context.WithValue(context.Background(), userKey{}, &User{Name: "alice", Roles: []string{"user"}})
+	job := &proto.StartJobRequest{Cmd: "echo", MemoryBytes: 100}
+
+	// a sweep is charged for the jobs it runs at the same time
+	res, err := s.StartBatch(ctx, &proto.StartBatchRequest{Job: job, Range: &proto.ParamRange{Start: 1, End: 100}, Parallelism: 5})
+	assert.NoError(t, err)
+	assert.Len(t, res.JobIds, 100)
+	usage := s.Quotas.Usage("alice")
+	assert.Equal(t, 5, usage.RunningJobs)
+	assert.Equal(t, uint64(500), usage.MemoryBytes)
+	assert.Equal(t, 100, usage.JobsLastHour)
+
+	_, err = s.StartBatch(ctx, &proto.StartBatchRequest{Job: job, Range: &proto.ParamRange{Start: 1, End: 100}, Parallelism: 6})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = s.StartBatch(ctx, &proto.StartBatchRequest{Job: job, Values: []string{"a", "b", "c", "d", "e", "f"}})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = s.StartBatch(ctx, &proto.StartBatchRequest{Job: job, Values: []string{"a", "b", "c", "d", "e"}})
+	assert.NoError(t, err)
+}
+
+func TestServer_StartWorkflow_Quota(t *testing.T) {
+	w := heldWorker{&statusWorker{jobs: make(map[string]worker.StatusEnum)}}
+	cfg := DefaultConfig()
+	cfg.Quotas = QuotaConfig{Roles: map[string]Quota{"user": {MaxRunningJobs: 3, MaxMemoryBytes: 300}}}
+	s := &Server{Config: cfg, Worker: w, UserJobStore: store.NewJobStore(), Quotas: NewQuotaTracker(cfg.Quotas, w)}
+	ctx := context.WithValue(context.Background(), userKey{}, &User{Name: "alice", Roles: []string{"user"}})
+	step := func(name string, memoryBytes uint64, dependsOn ...string) *proto.WorkflowStep {
+		ws := &proto.WorkflowStep{Name: name, Job: &proto.StartJobRequest{Cmd: "echo", MemoryBytes: memoryBytes}}
+		for _, dep := range dependsOn {
+			ws.DependsOn = append(ws.DependsOn, &proto.Dependency{Step: dep})
+		}
+		return ws
+	}
+
+	// the steps are admitted without another check once their dependencies end, a fan-out is charged as a whole
+	_, err := s.StartWorkflow(ctx, &proto.StartWorkflowRequest{Steps: []*proto.WorkflowStep{
+		step("build", 10), step("a", 10, "build"), step("b", 10, "build"), step("c", 10, "build"),
+	}})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = s.StartWorkflow(ctx, &proto.StartWorkflowRequest{Steps: []*proto.WorkflowStep{
+		step("build", 10), step("a", 200, "build"), step("b", 200, "build"),
+	}})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	_, err = s.StartWorkflow(ctx, &proto.StartWorkflowRequest{Steps: []*proto.WorkflowStep{
+		step("build", 10), step("test", 10, "build"), step("package", 10, "test"),
+	}})
+	assert.NoError(t, err)
+	usage := s.Quotas.Usage("alice")
+	assert.Equal(t, 3, usage.RunningJobs)
+	assert.Equal(t, uint64(30), usage.MemoryBytes)
+
+	_, err = s.StartWorkflow(ctx, &proto.StartWorkflowRequest{Steps: []*proto.WorkflowStep{step("build", 10)}})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestServer_StartJob_DelayedQuota(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Quotas = QuotaConfig{Roles: map[string]Quota{"user": {MaxRunningJobs: 1}}}
+	w := worker.NewWorker(cfg.Worker)
+	delayed, err := NewDelayedJobs("")
+	assert.NoError(t, err)
+	s := &Server{Config: cfg, Worker: w, UserJobStore: store.NewJobStore(), Quotas: NewQuotaTracker(cfg.Quotas, w), DelayedJobs: delayed}
+	user := &User{Name: "alice", Roles: []string{"user"}}
+
+	// scheduled jobs are admitted at their start time without another check, they are charged when submitted
+	jobID, err := s.startJob(user, &proto.StartJobRequest{Cmd: "true", StartAfterSeconds: 60}, "")
+	assert.NoError(t, err)
+	defer w.Stop(jobID)
+	_, err = s.startJob(user, &proto.StartJobRequest{Cmd: "true", StartAfterSeconds: 60}, "")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, 1, s.Quotas.Usage("alice").RunningJobs)
+}
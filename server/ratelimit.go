@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// retryAfterHeader is the response metadata key holding the seconds to wait before retrying a rate limited request
+const retryAfterHeader = "retry-after"
+
+// RateLimit limits the requests of a user, zero values are unlimited.
+type RateLimit struct {
+	// RequestsPerSecond is the rate at which requests are allowed for each method, with bursts up to Burst requests
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	// MaxStreams is the maximum number of concurrent streams opened by the user
+	MaxStreams int `json:"max_streams"`
+}
+
+// RateLimitConfig holds the rate limits of each role,
+// a user with several roles gets the most permissive limit of each role.
+type RateLimitConfig struct {
+	Roles map[string]RateLimit `json:"roles"`
+}
+
+// tokenBucket holds up to burst tokens refilled at rate tokens per second, a request takes a token
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token when available, else it returns the time until the next token is available
+func (b *tokenBucket) take(limit RateLimit, now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.RequestsPerSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.RequestsPerSecond * float64(time.Second))
+}
+
+type bucketKey struct {
+	user   string
+	method string
+}
+
+// rateLimiter limits the requests of each identity with a token bucket per method and caps their concurrent streams
+type rateLimiter struct {
+	cfg      RateLimitConfig
+	identity *identityResolver
+	buckets  map[bucketKey]*tokenBucket
+	streams  map[string]int
+	now      func() time.Time
+	sync.Mutex
+}
+
+func NewRateLimiter(cfg Config) (*rateLimiter, error) {
+	identity, err := newIdentityResolver(cfg.Identity)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimiter{
+		cfg:      cfg.RateLimits,
+		identity: identity,
+		buckets:  make(map[bucketKey]*tokenBucket),
+		streams:  make(map[string]int),
+		now:      time.Now,
+	}, nil
+}
+
+// UnaryRateLimitInterceptor rejects the unary calls exceeding the rate limit of the caller with ResourceExhausted
+func (l *rateLimiter) UnaryRateLimitInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	user, ok := UserFromContext(ctx)
+	if !ok {
+		return handler(ctx, req)
+	}
+	if allowed, retryAfter := l.allow(user, info.FullMethod); !allowed {
+		if err := grpc.SetHeader(ctx, retryAfterMetadata(retryAfter)); err != nil {
+			logrus.Errorf("failed to set retry-after header: %v", err)
+		}
+		return nil, status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry after %v", retryAfter)
+	}
+	return handler(ctx, req)
+}
+
+// StreamRateLimitInterceptor rejects the stream calls exceeding the rate limit or the concurrent streams limit of the caller with ResourceExhausted.
+// Streams are authorized on their first message, so the caller is identified from its certificate.
+func (l *rateLimiter) StreamRateLimitInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	user, err := peerUser(stream.Context(), l.identity)
+	if err != nil {
+		return handler(srv, stream)
+	}
+	if allowed, retryAfter := l.allow(user, info.FullMethod); !allowed {
+		if err := stream.SetHeader(retryAfterMetadata(retryAfter)); err != nil {
+			logrus.Errorf("failed to set retry-after header: %v", err)
+		}
+		return status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry after %v", retryAfter)
+	}
+	if !l.openStream(user) {
+		return status.Errorf(codes.ResourceExhausted, "too many concurrent streams")
+	}
+	defer l.closeStream(user)
+	return handler(srv, stream)
+}
+
+// limitFor returns the rate limit applying to the user
+func (l *rateLimiter) limitFor(user *User) RateLimit {
+	var limit RateLimit
+	found := false
+	for _, role := range user.Roles {
+		r, ok := l.cfg.Roles[role]
+		if !ok {
+			continue
+		}
+		// a burst of 0 allows a single request at a time rather than unlimited bursts
+		if r.Burst < 1 {
+			r.Burst = 1
+		}
+		if !found {
+			limit, found = r, true
+			continue
+		}
+		if limit.RequestsPerSecond != 0 && (r.RequestsPerSecond == 0 || r.RequestsPerSecond > limit.RequestsPerSecond) {
+			limit.RequestsPerSecond = r.RequestsPerSecond
+		}
+		if r.Burst > limit.Burst {
+			limit.Burst = r.Burst
+		}
+		limit.MaxStreams = int(maxLimit(uint64(limit.MaxStreams), uint64(r.MaxStreams)))
+	}
+	return limit
+}
+
+// allow takes a token from the bucket of the user for the method, else it returns the time to wait before retrying
+func (l *rateLimiter) allow(user *User, method string) (bool, time.Duration) {
+	limit := l.limitFor(user)
+	if limit.RequestsPerSecond == 0 {
+		return true, 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	key := bucketKey{user: user.Name, method: method}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+	return bucket.take(limit, now)
+}
+
+func (l *rateLimiter) openStream(user *User) bool {
+	limit := l.limitFor(user)
+	l.Lock()
+	defer l.Unlock()
+	if limit.MaxStreams != 0 && l.streams[user.Name] >= limit.MaxStreams {
+		return false
+	}
+	l.streams[user.Name]++
+	return true
+}
+
+func (l *rateLimiter) closeStream(user *User) {
+	l.Lock()
+	defer l.Unlock()
+	l.streams[user.Name]--
+	if l.streams[user.Name] <= 0 {
+		delete(l.streams, user.Name)
+	}
+}
+
+// retryAfterMetadata returns the retry-after header rounded up to the second
+func retryAfterMetadata(retryAfter time.Duration) metadata.MD {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return metadata.Pairs(retryAfterHeader, strconv.Itoa(seconds))
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RateLimits = RateLimitConfig{Roles: map[string]RateLimit{"user": {RequestsPerSecond: 1, Burst: 2}}}
+	l, err := NewRateLimiter(cfg)
+	assert.NoError(t, err)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	user := &User{Name: "alice", Roles: []string{"user"}}
+
+	for i := 0; i < 2; i++ {
+		allowed, _ := l.allow(user, "/proto.WorkerService/StartJob")
+		assert.True(t, allowed)
+	}
+	allowed, retryAfter := l.allow(user, "/proto.WorkerService/StartJob")
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, retryAfter)
+
+	// buckets are per method
+	allowed, _ = l.allow(user, "/proto.WorkerService/GetJobStatus")
+	assert.True(t, allowed)
+
+	now = now.Add(time.Second)
+	allowed, _ = l.allow(user, "/proto.WorkerService/StartJob")
+	assert.True(t, allowed)
+}
+
+func TestRateLimiter_MaxStreams(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RateLimits = RateLimitConfig{Roles: map[string]RateLimit{"user": {MaxStreams: 1}}}
+	l, err := NewRateLimiter(cfg)
+	assert.NoError(t, err)
+	user := &User{Name: "alice", Roles: []string{"user"}}
+
+	assert.True(t, l.openStream(user))
+	assert.False(t, l.openStream(user))
+	l.closeStream(user)
+	assert.True(t, l.openStream(user))
+}
+
+func TestRateLimiter_LimitFor(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RateLimits = RateLimitConfig{Roles: map[string]RateLimit{
+		"user":  {RequestsPerSecond: 1},
+		"ci":    {RequestsPerSecond: 2, Burst: 5},
+		"batch": {RequestsPerSecond: 1, MaxStreams: 3},
+	}}
+	l, err := NewRateLimiter(cfg)
+	assert.NoError(t, err)
+
+	assert.Equal(t, RateLimit{RequestsPerSecond: 1, Burst: 1}, l.limitFor(&User{Roles: []string{"user"}}))
+	assert.Equal(t, RateLimit{RequestsPerSecond: 2, Burst: 5}, l.limitFor(&User{Roles: []string{"user", "ci"}}))
+	assert.Equal(t, RateLimit{RequestsPerSecond: 2, Burst: 5}, l.limitFor(&User{Roles: []string{"ci", "user"}}))
+	// a burst of 0 is a burst of 1 rather than unlimited when merging roles
+	assert.Equal(t, RateLimit{RequestsPerSecond: 1, Burst: 1}, l.limitFor(&User{Roles: []string{"user", "batch"}}))
+}
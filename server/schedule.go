@@ -0,0 +1,316 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/mrinalirao/job-worker/cron"
+	"github.com/mrinalirao/job-worker/proto"
+	"github.com/mrinalirao/job-worker/worker"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Concurrency policies of a schedule, applied when the job of the previous run is still active
+const (
+	// ConcurrencyAllow starts the new job alongside the previous one
+	ConcurrencyAllow = "allow"
+	// ConcurrencyForbid skips the run
+	ConcurrencyForbid = "forbid"
+	// ConcurrencyReplace stops the previous job and starts the new one
+	ConcurrencyReplace = "replace"
+)
+
+var (
+	// ErrScheduleNotFound is returned for unknown schedule IDs
+	ErrScheduleNotFound = errors.New("schedule not found")
+	// ErrInvalidSchedule is returned when creating a schedule with an invalid cron expression or concurrency policy
+	ErrInvalidSchedule = errors.New("invalid schedule")
+)
+
+// Schedule starts a job each time its cron expression is due, as the user who created it
+type Schedule struct {
+	ID          string `json:"id"`
+	Cron        string `json:"cron"`
+	Concurrency string `json:"concurrency"`
+	// Owner, Roles and Groups are the identity of the creator at creation time
+	Owner  string   `json:"owner"`
+	Roles  []string `json:"roles,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Job is the StartJob request of the runs, in protobuf JSON
+	Job       json.RawMessage `json:"job"`
+	CreatedAt time.Time       `json:"created_at"`
+	LastRun   time.Time       `json:"last_run,omitempty"`
+	LastJobID string          `json:"last_job_id,omitempty"`
+	NextRun   time.Time       `json:"-"`
+}
+
+// StartScheduledJobFunc starts the job of a schedule run as the schedule owner
+type StartScheduledJobFunc func(scheduleID string, user *User, r *proto.StartJobRequest) (string, error)
+
+type scheduleEntry struct {
+	Schedule
+	cron  *cron.Schedule
+	job   *proto.StartJobRequest
+	timer *time.Timer
+}
+
+// Schedules runs the cron schedules and persists them to a JSON file so that they survive restarts.
+// Runs missed while the server was down are skipped. Persistence is disabled when no file is configured.
+type Schedules struct {
+	path    string
+	worker  worker.Worker
+	start   StartScheduledJobFunc
+	entries map[string]*scheduleEntry
+	now     func() time.Time
+	sync.Mutex
+}
+
+// NewSchedules loads the schedules persisted at path and arms them
+func NewSchedules(path string, w worker.Worker, start StartScheduledJobFunc) (*Schedules, error) {
+	s := &Schedules{
+		path:    path,
+		worker:  w,
+		start:   start,
+		entries: make(map[string]*scheduleEntry),
+		now:     time.Now,
+	}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schedules: %w", err)
+	}
+	var schedules []Schedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return nil, fmt.Errorf("failed to parse schedules: %w", err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, sched := range schedules {
+		entry, err := newScheduleEntry(sched)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load schedule %s: %w", sched.ID, err)
+		}
+		s.entries[sched.ID] = entry
+		s.arm(entry)
+	}
+	return s, nil
+}
+
+func newScheduleEntry(sched Schedule) (*scheduleEntry, error) {
+	c, err := cron.Parse(sched.Cron)
+	if err != nil {
+		return nil, err
+	}
+	job := &proto.StartJobRequest{}
+	if err := protojson.Unmarshal(sched.Job, job); err != nil {
+		return nil, err
+	}
+	return &scheduleEntry{Schedule: sched, cron: c, job: job}, nil
+}
+
+// Create validates and persists a new schedule of the job owned by the user, the concurrency policy defaults to allow
+func (s *Schedules) Create(user *User, expr string, concurrency string, job *proto.StartJobRequest) (Schedule, error) {
+	if concurrency == "" {
+		concurrency = ConcurrencyAllow
+	}
+	switch concurrency {
+	case ConcurrencyAllow, ConcurrencyForbid, ConcurrencyReplace:
+	default:
+		return Schedule{}, fmt.Errorf("%w: unknown concurrency policy %q", ErrInvalidSchedule, concurrency)
+	}
+	data, err := protojson.Marshal(job)
+	if err != nil {
+		return Schedule{}, err
+	}
+	entry, err := newScheduleEntry(Schedule{
+		ID:          uuid.New().String(),
+		Cron:        expr,
+		Concurrency: concurrency,
+		Owner:       user.Name,
+		Roles:       user.Roles,
+		Groups:      user.Groups,
+		Job:         data,
+		CreatedAt:   s.now(),
+	})
+	if err != nil {
+		return Schedule{}, fmt.Errorf("%w: %v", ErrInvalidSchedule, err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.entries[entry.ID] = entry
+	if err := s.save(); err != nil {
+		delete(s.entries, entry.ID)
+		return Schedule{}, err
+	}
+	s.arm(entry)
+	return entry.Schedule, nil
+}
+
+// List returns the schedules of the owner ordered by creation time, all schedules when owner is empty
+func (s *Schedules) List(owner string) []Schedule {
+	s.Lock()
+	defer s.Unlock()
+	var schedules []Schedule
+	for _, entry := range s.entries {
+		if owner == "" || entry.Owner == owner {
+			schedules = append(schedules, entry.Schedule)
+		}
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].CreatedAt.Before(schedules[j].CreatedAt)
+	})
+	return schedules
+}
+
+// Get returns the schedule with the ID
+func (s *Schedules) Get(id string) (Schedule, error) {
+	s.Lock()
+	defer s.Unlock()
+	entry, ok := s.entries[id]
+	if !ok {
+		return Schedule{}, ErrScheduleNotFound
+	}
+	return entry.Schedule, nil
+}
+
+// Delete removes the schedule, the jobs it already started keep running
+func (s *Schedules) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	entry, ok := s.entries[id]
+	if !ok {
+		return ErrScheduleNotFound
+	}
+	delete(s.entries, id)
+	if err := s.save(); err != nil {
+		s.entries[id] = entry
+		return err
+	}
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+	return nil
+}
+
+// Stop disarms the schedules
+func (s *Schedules) Stop() {
+	s.Lock()
+	defer s.Unlock()
+	for _, entry := range s.entries {
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+	}
+}
+
+// arm sets the timer of the next run of the schedule, the caller must hold the lock
+func (s *Schedules) arm(entry *scheduleEntry) {
+	entry.NextRun = entry.cron.Next(s.now())
+	if entry.NextRun.IsZero() {
+		logrus.WithField("ScheduleID", entry.ID).Errorf("cron expression %q is never due", entry.Cron)
+		return
+	}
+	entry.timer = time.AfterFunc(entry.NextRun.Sub(s.now()), func() {
+		s.run(entry.ID)
+	})
+}
+
+// run starts the job of a due schedule according to its concurrency policy and arms the next run.
+// The lock is not held while the job is started so that the schedules can be listed and deleted meanwhile.
+func (s *Schedules) run(id string) {
+	s.Lock()
+	entry, ok := s.entries[id]
+	if !ok {
+		s.Unlock()
+		return
+	}
+	sched, job := entry.Schedule, entry.job
+	s.Unlock()
+	log := logrus.WithFields(logrus.Fields{
+		"Action":     "RunSchedule",
+		"ScheduleID": id,
+	})
+
+	if sched.LastJobID != "" && s.active(sched.LastJobID) {
+		switch sched.Concurrency {
+		case ConcurrencyForbid:
+			log.Infof("skipping run, job %s is still active", sched.LastJobID)
+			s.Lock()
+			defer s.Unlock()
+			s.rearm(entry)
+			return
+		case ConcurrencyReplace:
+			if err := s.worker.Stop(sched.LastJobID); err != nil {
+				log.WithError(err).Errorf("failed to stop job %s", sched.LastJobID)
+			}
+		}
+	}
+	user := &User{Name: sched.Owner, Roles: sched.Roles, Groups: sched.Groups}
+	jobID, err := s.start(id, user, job)
+
+	s.Lock()
+	defer s.Unlock()
+	defer s.rearm(entry)
+	entry.LastRun = s.now()
+	if err != nil {
+		log.WithError(err).Error("failed to start scheduled job")
+		return
+	}
+	entry.LastJobID = jobID
+	if s.entries[id] != entry {
+		return
+	}
+	if err := s.save(); err != nil {
+		log.WithError(err).Error("failed to save schedules")
+	}
+}
+
+// rearm arms the next run of the schedule unless it was deleted during the run, the caller must hold the lock
+func (s *Schedules) rearm(entry *scheduleEntry) {
+	if s.entries[entry.ID] == entry {
+		s.arm(entry)
+	}
+}
+
+func (s *Schedules) active(jobID string) bool {
+	stat, err := s.worker.GetStatus(jobID)
+	return err == nil && !stat.JobStatus.Terminal()
+}
+
+// save writes the schedules to a temporary file renamed over the schedules file, the caller must hold the lock
+func (s *Schedules) save() error {
+	if s.path == "" {
+		return nil
+	}
+	schedules := make([]Schedule, 0, len(s.entries))
+	for _, entry := range s.entries {
+		schedules = append(schedules, entry.Schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].CreatedAt.Before(schedules[j].CreatedAt)
+	})
+	data, err := json.MarshalIndent(schedules, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode schedules: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write schedules: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write schedules: %w", err)
+	}
+	return nil
+}
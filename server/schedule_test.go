@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"github.com/mrinalirao/job-worker/proto"
+	"github.com/mrinalirao/job-worker/worker"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func (w *statusWorker) Stop(jobID string) error {
+	w.jobs[jobID] = worker.Stopped
+	return nil
+}
+
+// scheduleRuns returns a start function recording the users the jobs are started as
+func scheduleRuns(w *statusWorker, users *[]string) StartScheduledJobFunc {
+	return func(scheduleID string, user *User, r *proto.StartJobRequest) (string, error) {
+		*users = append(*users, user.Name)
+		return w.start()
+	}
+}
+
+func TestSchedules_Concurrency(t *testing.T) {
+	tests := []struct {
+		policy   string
+		runs     int
+		previous worker.StatusEnum
+	}{
+		{ConcurrencyAllow, 2, worker.Running},
+		{ConcurrencyForbid, 1, worker.Running},
+		{ConcurrencyReplace, 2, worker.Stopped},
+	}
+	for _, tt := range tests {
+		w := &statusWorker{jobs: make(map[string]worker.StatusEnum)}
+		var users []string
+		s, err := NewSchedules("", w, scheduleRuns(w, &users))
+		assert.NoError(t, err)
+		sched, err := s.Create(&User{Name: "alice"}, "@hourly", tt.policy, &proto.StartJobRequest{Cmd: "true"})
+		assert.NoError(t, err)
+
+		s.run(sched.ID)
+		s.run(sched.ID)
+		assert.Equal(t, tt.runs, len(users), tt.policy)
+		assert.Equal(t, tt.previous, w.jobs["0"], tt.policy)
+		s.Stop()
+	}
+}
+
+func TestSchedules_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedules.json")
+	w := &statusWorker{jobs: make(map[string]worker.StatusEnum)}
+	var users []string
+	s, err := NewSchedules(path, w, scheduleRuns(w, &users))
+	assert.NoError(t, err)
+	sched, err := s.Create(&User{Name: "alice", Roles: []string{"user"}}, "*/5 * * * *", "", &proto.StartJobRequest{Cmd: "echo", Args: []string{"hi"}})
+	assert.NoError(t, err)
+	assert.Equal(t, ConcurrencyAllow, sched.Concurrency)
+	_, err = s.Create(&User{Name: "bob"}, "@daily", ConcurrencyForbid, &proto.StartJobRequest{Cmd: "true"})
+	assert.NoError(t, err)
+	s.Stop()
+
+	reloaded, err := NewSchedules(path, w, scheduleRuns(w, &users))
+	assert.NoError(t, err)
+	defer reloaded.Stop()
+	assert.Equal(t, 2, len(reloaded.List("")))
+	schedules := reloaded.List("alice")
+	assert.Equal(t, 1, len(schedules))
+	assert.Equal(t, "*/5 * * * *", schedules[0].Cron)
+	assert.False(t, schedules[0].NextRun.IsZero())
+
+	reloaded.run(sched.ID)
+	assert.Equal(t, []string{"alice"}, users)
+	assert.NoError(t, reloaded.Delete(sched.ID))
+	assert.True(t, errors.Is(reloaded.Delete(sched.ID), ErrScheduleNotFound))
+}
+
+func TestSchedules_Invalid(t *testing.T) {
+	s, err := NewSchedules("", nil, nil)
+	assert.NoError(t, err)
+	_, err = s.Create(&User{Name: "alice"}, "* * *", "", &proto.StartJobRequest{})
+	assert.True(t, errors.Is(err, ErrInvalidSchedule))
+	_, err = s.Create(&User{Name: "alice"}, "@daily", "sometimes", &proto.StartJobRequest{})
+	assert.True(t, errors.Is(err, ErrInvalidSchedule))
+}
+
+func TestSchedules_RunWithoutLock(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	s, err := NewSchedules("", nil, func(scheduleID string, user *User, r *proto.StartJobRequest) (string, error) {
+		close(started)
+		<-release
+		return "job", nil
+	})
+	assert.NoError(t, err)
+	sched, err := s.Create(&User{Name: "alice"}, "@hourly", "", &proto.StartJobRequest{Cmd: "true"})
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		s.run(sched.ID)
+		close(done)
+	}()
+	<-started
+	// the schedules can be listed and deleted while the job is started
+	assert.Equal(t, 1, len(s.List("alice")))
+	assert.NoError(t, s.Delete(sched.ID))
+	close(release)
+	<-done
+	assert.Empty(t, s.List(""))
+	s.Stop()
+}
@@ -13,12 +13,20 @@ import (
 	"google.golang.org/grpc/credentials"
 	"net"
 	"os"
+	"time"
 )
 
 type Server struct {
 	proto.UnimplementedWorkerServiceServer
-	Worker       worker.Worker
-	UserJobStore store.JobUserStore
+	Config          Config
+	Worker          worker.Worker
+	UserJobStore    store.JobUserStore
+	ShareTokens     *ShareTokenSigner
+	AuditLog        *AuditLog
+	Quotas          *QuotaTracker
+	Schedules       *Schedules
+	DelayedJobs     *DelayedJobs
+	IdempotencyKeys *IdempotencyKeys
 }
 
 func loadTLSCredentials() (credentials.TransportCredentials, error) {
@@ -50,32 +58,74 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
 	return credentials.NewTLS(config), nil
 }
 
-func createServer(cred credentials.TransportCredentials) (*grpc.Server, net.Listener, error) {
+func createServer(cfg Config, cred credentials.TransportCredentials) (*grpc.Server, net.Listener, error) {
 	// TODO: pass in server address from config file
 	lis, err := net.Listen("tcp", ":8010")
 	if err != nil {
 		return nil, nil, err
 	}
 	userJobStore := store.NewJobStore()
-	interceptor := NewInterceptor(userJobStore)
+	shareTokens, err := NewShareTokenSigner(cfg.ShareTokens)
+	if err != nil {
+		lis.Close()
+		return nil, nil, err
+	}
+	auditLog, err := NewAuditLog(cfg.AuditLogPath)
+	if err != nil {
+		lis.Close()
+		return nil, nil, err
+	}
+	interceptor, err := NewInterceptor(userJobStore, shareTokens, auditLog, cfg)
+	if err != nil {
+		lis.Close()
+		auditLog.Close()
+		return nil, nil, err
+	}
+	rateLimiter, err := NewRateLimiter(cfg)
+	if err != nil {
+		lis.Close()
+		auditLog.Close()
+		return nil, nil, err
+	}
 	grpcServer := grpc.NewServer(
 		grpc.Creds(cred),
-		grpc.UnaryInterceptor(interceptor.UnaryAuthInterceptor),
-		grpc.StreamInterceptor(interceptor.StreamAuthInterceptor),
+		grpc.ChainUnaryInterceptor(interceptor.UnaryAuthInterceptor, rateLimiter.UnaryRateLimitInterceptor),
+		grpc.ChainStreamInterceptor(interceptor.StreamAuthInterceptor, rateLimiter.StreamRateLimitInterceptor),
 	)
-	proto.RegisterWorkerServiceServer(grpcServer, &Server{
-		Worker:       worker.NewWorker(),
-		UserJobStore: userJobStore,
-	})
+	delayedJobs, err := NewDelayedJobs(cfg.DelayedJobsPath)
+	if err != nil {
+		lis.Close()
+		auditLog.Close()
+		return nil, nil, err
+	}
+	w := worker.NewWorker(cfg.Worker)
+	srv := &Server{
+		Config:          cfg,
+		Worker:          w,
+		UserJobStore:    userJobStore,
+		ShareTokens:     shareTokens,
+		AuditLog:        auditLog,
+		Quotas:          NewQuotaTracker(cfg.Quotas, w),
+		DelayedJobs:     delayedJobs,
+		IdempotencyKeys: NewIdempotencyKeys(time.Duration(cfg.IdempotencyWindowSeconds) * time.Second),
+	}
+	srv.restoreDelayedJobs()
+	srv.Schedules, err = NewSchedules(cfg.SchedulesPath, w, srv.startScheduledJob)
+	if err != nil {
+		lis.Close()
+		auditLog.Close()
+		return nil, nil, err
+	}
+	proto.RegisterWorkerServiceServer(grpcServer, srv)
 	return grpcServer, lis, nil
 }
 
-func RunServer() error {
+func RunServer(cfg Config) error {
 	cred, err := loadTLSCredentials()
 	if err != nil {
 		return err
 	}
-	serv, lis, err := createServer(cred)
+	serv, lis, err := createServer(cfg, cred)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shareTokenHeader is the gRPC metadata key carrying a share token
+const shareTokenHeader = "x-share-token"
+
+// shareScopeRead is the only scope of share tokens: job status and output stream
+const shareScopeRead = "read"
+
+// shareTokenMethods are the methods of the read scope, other read methods of the group access such as AttachJob are not shared
+var shareTokenMethods = map[string]bool{
+	"/proto.WorkerService/GetJobStatus":    true,
+	"/proto.WorkerService/GetOutputStream": true,
+}
+
+// ShareTokenConfig configures the signed tokens giving read-only access to a single job.
+type ShareTokenConfig struct {
+	// SecretFile holds the HMAC key used to sign tokens. A random key is generated at startup when empty,
+	// in which case the tokens are invalidated on restart.
+	SecretFile        string `json:"secret_file"`
+	DefaultTTLSeconds int64  `json:"default_ttl_seconds"`
+	MaxTTLSeconds     int64  `json:"max_ttl_seconds"`
+}
+
+// ShareTokenSigner issues and verifies HMAC-SHA256 signed tokens scoped to one job ID and read-only operations.
+// A token is made of the base64 encoded payload "<jobID>|<expiry unix time>|<scope>" and its signature separated by a dot.
+type ShareTokenSigner struct {
+	key        []byte
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+	now        func() time.Time
+}
+
+func NewShareTokenSigner(cfg ShareTokenConfig) (*ShareTokenSigner, error) {
+	var key []byte
+	if cfg.SecretFile != "" {
+		secret, err := os.ReadFile(cfg.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read share token secret: %w", err)
+		}
+		key = []byte(strings.TrimSpace(string(secret)))
+	} else {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate share token secret: %w", err)
+		}
+	}
+	if len(key) == 0 {
+		return nil, errors.New("empty share token secret")
+	}
+	return &ShareTokenSigner{
+		key:        key,
+		defaultTTL: time.Duration(cfg.DefaultTTLSeconds) * time.Second,
+		maxTTL:     time.Duration(cfg.MaxTTLSeconds) * time.Second,
+		now:        time.Now,
+	}, nil
+}
+
+// Issue returns a token giving read-only access to the job for the ttl, the default ttl is used when ttl is 0.
+func (s *ShareTokenSigner) Issue(jobID string, ttl time.Duration) (string, time.Time, error) {
+	if ttl == 0 {
+		ttl = s.defaultTTL
+	}
+	if ttl < 0 || ttl > s.maxTTL {
+		return "", time.Time{}, fmt.Errorf("ttl must be between 0 and %v", s.maxTTL)
+	}
+	expiresAt := s.now().Add(ttl).Truncate(time.Second)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s|%d|%s", jobID, expiresAt.Unix(), shareScopeRead)))
+	return payload + "." + s.sign(payload), expiresAt, nil
+}
+
+// Verify checks the token signature and that it grants read access to the job and is not expired.
+func (s *ShareTokenSigner) Verify(token string, jobID string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return errors.New("malformed share token")
+	}
+	if !hmac.Equal([]byte(s.sign(parts[0])), []byte(parts[1])) {
+		return errors.New("invalid share token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.New("malformed share token")
+	}
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 3 {
+		return errors.New("malformed share token")
+	}
+	expiry, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return errors.New("malformed share token")
+	}
+	if fields[0] != jobID || fields[2] != shareScopeRead {
+		return errors.New("share token does not grant access to this job")
+	}
+	if s.now().Unix() >= expiry {
+		return errors.New("share token expired")
+	}
+	return nil
+}
+
+func (s *ShareTokenSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
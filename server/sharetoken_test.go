@@ -0,0 +1,32 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestShareTokenSigner_IssueVerify(t *testing.T) {
+	s, err := NewShareTokenSigner(ShareTokenConfig{DefaultTTLSeconds: 60, MaxTTLSeconds: 3600})
+	assert.NoError(t, err)
+
+	token, expiresAt, err := s.Issue("job-1", 0)
+	assert.NoError(t, err)
+	assert.True(t, expiresAt.After(time.Now()))
+	assert.NoError(t, s.Verify(token, "job-1"))
+	assert.Error(t, s.Verify(token, "job-2"))
+	assert.Error(t, s.Verify(token+"x", "job-1"))
+
+	_, _, err = s.Issue("job-1", 2*time.Hour)
+	assert.Error(t, err)
+}
+
+func TestShareTokenSigner_Expired(t *testing.T) {
+	s, err := NewShareTokenSigner(ShareTokenConfig{DefaultTTLSeconds: 60, MaxTTLSeconds: 3600})
+	assert.NoError(t, err)
+	token, _, err := s.Issue("job-1", time.Minute)
+	assert.NoError(t, err)
+
+	s.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	assert.Error(t, s.Verify(token, "job-1"))
+}
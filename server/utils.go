@@ -2,14 +2,28 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/mrinalirao/job-worker/proto"
+	"github.com/mrinalirao/job-worker/store"
+	"github.com/mrinalirao/job-worker/worker"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
 type userKey struct{}
 
+// User is the authenticated caller of a request
 type User struct {
-	Name string
+	Name   string
+	Roles  []string
+	Groups []string
+	// ShareToken is set when the request is authorized by a share token rather than the user roles
+	ShareToken bool
 }
 
 // oidRole oid identifier used to store user roles
@@ -22,10 +36,85 @@ func ParseRoles(roles string) []string {
 
 // access map initialization
 var access = map[string][]string{
-	"/proto.WorkerService/StartJob":        {"admin", "user"},
-	"/proto.WorkerService/StopJob":         {"admin", "user"},
-	"/proto.WorkerService/GetJobStatus":    {"admin", "user"},
-	"/proto.WorkerService/GetOutputStream": {"admin", "user"},
+	"/proto.WorkerService/StartJob":          {"admin", "user"},
+	"/proto.WorkerService/StopJob":           {"admin", "user"},
+	"/proto.WorkerService/GetJobStatus":      {"admin", "user"},
+	"/proto.WorkerService/GetOutputStream":   {"admin", "user"},
+	"/proto.WorkerService/CreateShareToken":  {"admin", "user"},
+	"/proto.WorkerService/QueryAudit":        {"admin"},
+	"/proto.WorkerService/GetQuotaUsage":     {"admin", "user"},
+	"/proto.WorkerService/CreateSchedule":    {"admin", "user"},
+	"/proto.WorkerService/ListSchedules":     {"admin", "user"},
+	"/proto.WorkerService/DeleteSchedule":    {"admin", "user"},
+	"/proto.WorkerService/StartWorkflow":     {"admin", "user"},
+	"/proto.WorkerService/GetWorkflowStatus": {"admin", "user"},
+	"/proto.WorkerService/StopWorkflow":      {"admin", "user"},
+	"/proto.WorkerService/StartBatch":        {"admin", "user"},
+	"/proto.WorkerService/GetBatchStatus":    {"admin", "user"},
+	"/proto.WorkerService/StopBatch":         {"admin", "user"},
+	"/proto.WorkerService/ListJobs":          {"admin", "user"},
+	"/proto.WorkerService/StopJobs":          {"admin", "user"},
+	"/proto.WorkerService/WriteStdin":        {"admin", "user"},
+	"/proto.WorkerService/AttachJob":         {"admin", "user"},
+	"/proto.WorkerService/ExecInJob":         {"admin", "user"},
+}
+
+// Access levels granted to members of the group owning a job
+const (
+	groupAccessNone    = "none"
+	groupAccessRead    = "read"
+	groupAccessControl = "control"
+)
+
+// jobAccess is the group access level required by methods accessing an existing job,
+// none denies the members of the group whatever the policy, eg: running processes as the owner of the job
+var jobAccess = map[string]string{
+	"/proto.WorkerService/StopJob":           groupAccessControl,
+	"/proto.WorkerService/GetJobStatus":      groupAccessRead,
+	"/proto.WorkerService/GetOutputStream":   groupAccessRead,
+	"/proto.WorkerService/GetWorkflowStatus": groupAccessRead,
+	"/proto.WorkerService/StopWorkflow":      groupAccessControl,
+	"/proto.WorkerService/GetBatchStatus":    groupAccessRead,
+	"/proto.WorkerService/StopBatch":         groupAccessControl,
+	"/proto.WorkerService/AttachJob":         groupAccessRead,
+	"/proto.WorkerService/ExecInJob":         groupAccessNone,
+}
+
+// ownerOnly are the methods restricted to the owner of the job, admins and group members cannot call them on the jobs of other users
+var ownerOnly = map[string]bool{
+	"/proto.WorkerService/WriteStdin": true,
+}
+
+// groupAllows verifies the group access level given by the policy grants the access required by the method
+func groupAllows(policy string, method string) bool {
+	required, ok := jobAccess[method]
+	if !ok {
+		required = groupAccessControl
+	}
+	if required == groupAccessNone {
+		return false
+	}
+	switch policy {
+	case groupAccessControl:
+		return true
+	case groupAccessRead:
+		return required == groupAccessRead
+	default:
+		return false
+	}
+}
+
+// canAccessJob verifies the user can call the method on a job of the owner.
+// Owner-only methods, eg: WriteStdin, are restricted to the owner of the job, even for admins.
+// Otherwise admins can access all jobs, other users can access their own jobs and the jobs of their groups as allowed by the group access policy
+func canAccessJob(user *User, owner store.Owner, policy string, method string) bool {
+	if ownerOnly[method] {
+		return owner.User == user.Name
+	}
+	if contains("admin", user.Roles) || owner.User == user.Name {
+		return true
+	}
+	return owner.Group != "" && contains(owner.Group, user.Groups) && groupAllows(policy, method)
 }
 
 // HasAccess verifies the access for a method and user roles
@@ -53,6 +142,189 @@ func contains(a string, list []string) bool {
 	return false
 }
 
+// appendUnique appends the non empty values that are not already in the list
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		if v != "" && !contains(v, list) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// capPriority caps the requested priority to the highest priority allowed for the user roles, and raises it to the lowest priority
+func capPriority(maxPriority map[string]int, minPriority int, roles []string, priority int) int {
+	limit := 0
+	for _, role := range roles {
+		if max, ok := maxPriority[role]; ok && max > limit {
+			limit = max
+		}
+	}
+	if priority > limit {
+		return limit
+	}
+	if priority < minPriority {
+		return minPriority
+	}
+	return priority
+}
+
+// retryPolicyFromRequest converts the retry policy of a StartJob request
+func retryPolicyFromRequest(r *proto.RetryPolicy) worker.RetryPolicy {
+	policy := worker.RetryPolicy{
+		MaxAttempts:    int(r.GetMaxAttempts()),
+		InitialBackoff: time.Duration(r.GetInitialBackoffMs()) * time.Millisecond,
+		MaxBackoff:     time.Duration(r.GetMaxBackoffMs()) * time.Millisecond,
+		RetryOnTimeout: r.GetRetryOnTimeout(),
+	}
+	for _, code := range r.GetRetryableExitCodes() {
+		policy.RetryableExitCodes = append(policy.RetryableExitCodes, int(code))
+	}
+	return policy
+}
+
+// restartPolicyFromRequest converts the restart policy of a StartJob request, the policy defaults to never
+func restartPolicyFromRequest(r *proto.RestartPolicy) worker.RestartPolicy {
+	policy := worker.RestartPolicy{
+		Policy:         r.GetPolicy(),
+		MaxRestarts:    int(r.GetMaxRestarts()),
+		InitialBackoff: time.Duration(r.GetInitialBackoffMs()) * time.Millisecond,
+		MaxBackoff:     time.Duration(r.GetMaxBackoffMs()) * time.Millisecond,
+	}
+	if policy.Policy == "" {
+		policy.Policy = worker.RestartNever
+	}
+	return policy
+}
+
+// statusToProto converts a job status to its API status
+func statusToProto(stat worker.StatusEnum) (proto.Status, bool) {
+	switch stat {
+	case worker.Running:
+		return proto.Status_RUNNING, true
+	case worker.Finished:
+		return proto.Status_FINISHED, true
+	case worker.Stopped:
+		return proto.Status_STOPPED, true
+	case worker.Pending:
+		return proto.Status_PENDING, true
+	case worker.Preempted:
+		return proto.Status_PREEMPTED, true
+	case worker.TimedOut:
+		return proto.Status_TIMED_OUT, true
+	case worker.Scheduled:
+		return proto.Status_SCHEDULED, true
+	case worker.Waiting:
+		return proto.Status_WAITING, true
+	case worker.Skipped:
+		return proto.Status_SKIPPED, true
+	default:
+		return 0, false
+	}
+}
+
+// jobInfoToProto converts a listed job to its API representation
+func jobInfoToProto(job worker.JobInfo) *proto.JobInfo {
+	jobStatus, _ := statusToProto(job.JobStatus)
+	return &proto.JobInfo{
+		Id:        job.ID,
+		Name:      job.Spec.Name,
+		Owner:     job.Spec.Owner,
+		Labels:    job.Spec.Labels,
+		Cmd:       job.Spec.Cmd,
+		Args:      job.Spec.Args,
+		Status:    jobStatus,
+		Exitcode:  int32(job.ExitCode),
+		CreatedAt: job.CreatedAt.Unix(),
+	}
+}
+
+// statusFromProto converts an API status to a job status
+func statusFromProto(stat proto.Status) (worker.StatusEnum, bool) {
+	for _, s := range []worker.StatusEnum{worker.Running, worker.Finished, worker.Stopped, worker.Pending, worker.Preempted,
+		worker.TimedOut, worker.Scheduled, worker.Waiting, worker.Skipped} {
+		if p, _ := statusToProto(s); p == stat {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// maxBatchSize bounds the number of jobs of a batch
+const maxBatchSize = 10000
+
+// batchParams returns the parameters of a batch, given as a list of values or as a range
+func batchParams(r *proto.StartBatchRequest) ([]string, error) {
+	if len(r.GetValues()) > 0 && r.GetRange() != nil {
+		return nil, errors.New("values and range cannot be both set")
+	}
+	params := r.GetValues()
+	if rng := r.GetRange(); rng != nil {
+		step := rng.GetStep()
+		if step == 0 {
+			step = 1
+		}
+		if step < 0 || rng.GetEnd() < rng.GetStart() {
+			return nil, errors.New("invalid range")
+		}
+		// the span of the range may not fit in an int64, the values are computed in uint64 which wraps around to the right value
+		span := uint64(rng.GetEnd()) - uint64(rng.GetStart())
+		if span/uint64(step) >= maxBatchSize {
+			return nil, fmt.Errorf("batches are limited to %d jobs", maxBatchSize)
+		}
+		count := int(span/uint64(step)) + 1
+		params = make([]string, count)
+		for i := range params {
+			params[i] = strconv.FormatInt(int64(uint64(rng.GetStart())+uint64(i)*uint64(step)), 10)
+		}
+	}
+	if len(params) == 0 {
+		return nil, errors.New("batch has no parameters")
+	}
+	if len(params) > maxBatchSize {
+		return nil, fmt.Errorf("batches are limited to %d jobs", maxBatchSize)
+	}
+	return params, nil
+}
+
+// workflowStatusToProto converts an aggregate workflow status to its API status
+func workflowStatusToProto(stat worker.WorkflowStatusEnum) proto.WorkflowStatus {
+	switch stat {
+	case worker.WorkflowSucceeded:
+		return proto.WorkflowStatus_WORKFLOW_SUCCEEDED
+	case worker.WorkflowFailed:
+		return proto.WorkflowStatus_WORKFLOW_FAILED
+	case worker.WorkflowStopped:
+		return proto.WorkflowStatus_WORKFLOW_STOPPED
+	default:
+		return proto.WorkflowStatus_WORKFLOW_RUNNING
+	}
+}
+
+// scheduleToProto converts a schedule to its API representation, the stored job request was validated on creation
+func scheduleToProto(sched Schedule) *proto.Schedule {
+	job := &proto.StartJobRequest{}
+	if err := protojson.Unmarshal(sched.Job, job); err != nil {
+		logrus.WithField("ScheduleID", sched.ID).Errorf("failed to decode scheduled job: %v", err)
+	}
+	res := &proto.Schedule{
+		Id:                sched.ID,
+		Owner:             sched.Owner,
+		Cron:              sched.Cron,
+		ConcurrencyPolicy: sched.Concurrency,
+		Job:               job,
+		CreatedAt:         sched.CreatedAt.Unix(),
+		LastJobId:         sched.LastJobID,
+	}
+	if !sched.LastRun.IsZero() {
+		res.LastRun = sched.LastRun.Unix()
+	}
+	if !sched.NextRun.IsZero() {
+		res.NextRun = sched.NextRun.Unix()
+	}
+	return res
+}
+
 func UserFromContext(ctx context.Context) (*User, bool) {
 	if u := ctx.Value(userKey{}); u != nil {
 		return u.(*User), true
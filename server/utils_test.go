@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"github.com/mrinalirao/job-worker/proto"
+	"github.com/mrinalirao/job-worker/store"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+const (
+	stopJob      = "/proto.WorkerService/StopJob"
+	getJobStatus = "/proto.WorkerService/GetJobStatus"
+)
+
+func TestGroupAllows(t *testing.T) {
+	tests := []struct {
+		policy string
+		method string
+		allow  bool
+	}{
+		{groupAccessNone, getJobStatus, false},
+		{groupAccessNone, stopJob, false},
+		{groupAccessRead, getJobStatus, true},
+		{groupAccessRead, "/proto.WorkerService/GetOutputStream", true},
+		{groupAccessRead, stopJob, false},
+		{groupAccessRead, "/proto.WorkerService/StopWorkflow", false},
+		{groupAccessControl, getJobStatus, true},
+		{groupAccessControl, stopJob, true},
+		{groupAccessControl, "/proto.WorkerService/StopBatch", true},
+		// methods without a group access level require control
+		{groupAccessRead, "/proto.WorkerService/Unknown", false},
+		{groupAccessControl, "/proto.WorkerService/Unknown", true},
+		// methods with the none level are denied to groups whatever the policy
+		{groupAccessControl, "/proto.WorkerService/ExecInJob", false},
+		{"", getJobStatus, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.allow, groupAllows(tt.policy, tt.method), "%s %s", tt.policy, tt.method)
+	}
+}
+
+func TestCanAccessJob(t *testing.T) {
+	owner := store.Owner{User: "alice", Group: "ci"}
+	alice := &User{Name: "alice", Roles: []string{"user"}, Groups: []string{"ci"}}
+	bob := &User{Name: "bob", Roles: []string{"user"}, Groups: []string{"ci"}}
+	carol := &User{Name: "carol", Roles: []string{"user"}, Groups: []string{"ops"}}
+	admin := &User{Name: "root", Roles: []string{"admin"}}
+	tests := []struct {
+		user   *User
+		owner  store.Owner
+		policy string
+		method string
+		allow  bool
+	}{
+		{alice, owner, groupAccessNone, stopJob, true},
+		{admin, owner, groupAccessNone, stopJob, true},
+		{bob, owner, groupAccessNone, getJobStatus, false},
+		{bob, owner, groupAccessRead, getJobStatus, true},
+		{bob, owner, groupAccessRead, stopJob, false},
+		{bob, owner, groupAccessControl, stopJob, true},
+		{carol, owner, groupAccessControl, getJobStatus, false},
+		// jobs started without a group are not shared
+		{bob, store.Owner{User: "alice"}, groupAccessControl, getJobStatus, false},
+		// owner only methods are denied to admins and group members
+		{alice, owner, groupAccessNone, "/proto.WorkerService/WriteStdin", true},
+		{admin, owner, groupAccessControl, "/proto.WorkerService/WriteStdin", false},
+		{bob, owner, groupAccessControl, "/proto.WorkerService/WriteStdin", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.allow, canAccessJob(tt.user, tt.owner, tt.policy, tt.method), "%s %s %s", tt.user.Name, tt.policy, tt.method)
+	}
+}
+
+func TestInterceptor_VerifyAuthenticatedUser_Group(t *testing.T) {
+	jobs := store.NewJobStore()
+	assert.NoError(t, jobs.SetJobOwner("job", store.Owner{User: "alice", Group: "ci"}))
+	bob := &User{Name: "bob", Roles: []string{"user"}, Groups: []string{"ci"}}
+	carol := &User{Name: "carol", Roles: []string{"user"}, Groups: []string{"ops"}}
+
+	i := &interceptor{jobUserStore: jobs, groupAccess: groupAccessRead}
+	ctx, err := i.verifyAuthenticatedUser(context.Background(), getJobStatus, "job", bob)
+	assert.NoError(t, err)
+	user, ok := UserFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "bob", user.Name)
+	_, err = i.verifyAuthenticatedUser(context.Background(), stopJob, "job", bob)
+	assert.Error(t, err)
+	_, err = i.verifyAuthenticatedUser(context.Background(), getJobStatus, "job", carol)
+	assert.Error(t, err)
+	_, err = i.verifyAuthenticatedUser(context.Background(), getJobStatus, "missing", bob)
+	assert.Error(t, err)
+
+	i.groupAccess = groupAccessControl
+	_, err = i.verifyAuthenticatedUser(context.Background(), stopJob, "job", bob)
+	assert.NoError(t, err)
+	i.groupAccess = groupAccessNone
+	_, err = i.verifyAuthenticatedUser(context.Background(), getJobStatus, "job", bob)
+	assert.Error(t, err)
+}
+
+func TestBatchParams_Range(t *testing.T) {
+	tests := []struct {
+		rng    *proto.ParamRange
+		params []string
+	}{
+		{&proto.ParamRange{Start: 1, End: 3}, []string{"1", "2", "3"}},
+		{&proto.ParamRange{Start: 0, End: 10, Step: 4}, []string{"0", "4", "8"}},
+		{&proto.ParamRange{Start: -2, End: -2}, []string{"-2"}},
+		{&proto.ParamRange{Start: math.MaxInt64 - 1, End: math.MaxInt64}, []string{"9223372036854775806", "9223372036854775807"}},
+		{&proto.ParamRange{Start: math.MinInt64, End: math.MinInt64 + 1}, []string{"-9223372036854775808", "-9223372036854775807"}},
+		{&proto.ParamRange{Start: math.MinInt64, End: math.MaxInt64, Step: math.MaxInt64}, []string{"-9223372036854775808", "-1", "9223372036854775806"}},
+		{&proto.ParamRange{Start: 0, End: math.MaxInt64, Step: math.MaxInt64}, []string{"0", "9223372036854775807"}},
+	}
+	for _, tt := range tests {
+		params, err := batchParams(&proto.StartBatchRequest{Range: tt.rng})
+		assert.NoError(t, err, tt.rng.String())
+		assert.Equal(t, tt.params, params, tt.rng.String())
+	}
+
+	for _, rng := range []*proto.ParamRange{
+		{Start: math.MinInt64, End: math.MaxInt64},
+		{Start: 0, End: maxBatchSize},
+		{Start: 3, End: 1},
+		{Start: 1, End: 3, Step: -1},
+	} {
+		_, err := batchParams(&proto.StartBatchRequest{Range: rng})
+		assert.Error(t, err, rng.String())
+	}
+	params, err := batchParams(&proto.StartBatchRequest{Range: &proto.ParamRange{Start: 1, End: maxBatchSize}})
+	assert.NoError(t, err)
+	assert.Len(t, params, maxBatchSize)
+}
+
+func TestCapPriority(t *testing.T) {
+	maxPriority := map[string]int{"ci": 10, "admin": 100}
+	tests := []struct {
+		roles    []string
+		priority int
+		capped   int
+	}{
+		{[]string{"user"}, 5, 0},
+		{[]string{"user"}, -5, -5},
+		{[]string{"ci"}, 5, 5},
+		{[]string{"ci"}, 50, 10},
+		{[]string{"ci", "admin"}, 50, 50},
+		{[]string{"admin"}, -1000, -1000},
+		{[]string{"user"}, -1001, -1000},
+		{[]string{"admin"}, math.MinInt32, -1000},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.capped, capPriority(maxPriority, -1000, tt.roles, tt.priority), "%v %d", tt.roles, tt.priority)
+	}
+}
@@ -6,48 +6,82 @@ import (
 	"sync"
 )
 
-// jobUserStore keeps a map of jobIDs to their userIDs, this is required prevent unauthorized access to jobs
+// Owner identifies the user who started a job and the group the job is shared with, if any
+type Owner struct {
+	User  string
+	Group string
+}
+
+// jobUserStore keeps a map of jobIDs to their owners, this is required prevent unauthorized access to jobs.
+// Workflows and batches are kept by their ID as well.
 type jobUserStore struct {
-	jobUserMap map[string]string
+	jobOwnerMap map[string]Owner
+	// jobNameMap maps the job names of each user to the last job started with the name
+	jobNameMap map[string]map[string]string
 	sync.RWMutex
 }
 
 type JobUserStore interface {
-	SetJobUser(jobID string, userID string) error
-	GetUser(jobID string) (string, error)
+	SetJobOwner(jobID string, owner Owner) error
+	GetOwner(jobID string) (Owner, error)
+	SetJobName(user string, name string, jobID string)
+	GetJobByName(user string, name string) (string, error)
 }
 
 func NewJobStore() JobUserStore {
 	return &jobUserStore{
-		jobUserMap: make(map[string]string),
+		jobOwnerMap: make(map[string]Owner),
+		jobNameMap:  make(map[string]map[string]string),
 	}
 }
 
-func (j *jobUserStore) SetJobUser(jobID string, userID string) error {
+func (j *jobUserStore) SetJobOwner(jobID string, owner Owner) error {
 	logFields := logrus.Fields{
-		"Action": "SetUser",
+		"Action": "SetOwner",
 		"JobID":  jobID,
-		"UserID": userID,
+		"UserID": owner.User,
+		"Group":  owner.Group,
 	}
 	j.Lock()
 	defer j.Unlock()
-	if v, ok := j.jobUserMap[jobID]; ok {
-		logrus.WithFields(logFields).Errorf("job already exists with user: %s", v)
-		if v != userID {
-			return fmt.Errorf("failed to set job:%s for user: %s", jobID, userID)
+	if v, ok := j.jobOwnerMap[jobID]; ok {
+		logrus.WithFields(logFields).Errorf("job already exists with user: %s", v.User)
+		if v != owner {
+			return fmt.Errorf("failed to set job:%s for user: %s", jobID, owner.User)
 		}
 		return nil
 	}
-	j.jobUserMap[jobID] = userID
+	j.jobOwnerMap[jobID] = owner
 	return nil
 }
 
-func (j *jobUserStore) GetUser(jobID string) (string, error) {
+func (j *jobUserStore) GetOwner(jobID string) (Owner, error) {
 	j.RLock()
 	defer j.RUnlock()
-	v, ok := j.jobUserMap[jobID]
+	v, ok := j.jobOwnerMap[jobID]
 	if !ok {
-		return "", fmt.Errorf("job does not exist: %v", jobID)
+		return Owner{}, fmt.Errorf("job does not exist: %v", jobID)
 	}
 	return v, nil
 }
+
+// SetJobName records the job as the last job of the user with the name
+func (j *jobUserStore) SetJobName(user string, name string, jobID string) {
+	j.Lock()
+	defer j.Unlock()
+	if j.jobNameMap[user] == nil {
+		j.jobNameMap[user] = make(map[string]string)
+	}
+	j.jobNameMap[user][name] = jobID
+}
+
+// GetJobByName returns the last job of the user with the name
+func (j *jobUserStore) GetJobByName(user string, name string) (string, error) {
+	j.RLock()
+	defer j.RUnlock()
+	jobID, ok := j.jobNameMap[user][name]
+	if !ok {
+		return "", fmt.Errorf("job does not exist: %v", name)
+	}
+	return jobID, nil
+}
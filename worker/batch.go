@@ -0,0 +1,215 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Placeholders replaced in the command, arguments and environment of the template of a batch
+const (
+	BatchParamPlaceholder = "{{param}}"
+	BatchIndexPlaceholder = "{{index}}"
+)
+
+// BatchSpec expands a template job over a list of parameters, a job is created for each parameter
+type BatchSpec struct {
+	// Template is the spec of the jobs, the placeholders are replaced by the parameter and its 0-based index in the name,
+	// command, arguments and environment.
+	// BATCH_PARAM and BATCH_INDEX are added to the environment of each job.
+	Template JobSpec
+	Params   []string
+	// Parallelism is the maximum number of jobs of the batch admitted at the same time, 0 is unlimited.
+	// The other jobs are Waiting and admitted in the order of the parameters as the admitted jobs end.
+	Parallelism int
+}
+
+// Batch identifies a started batch and its jobs in the order of the parameters
+type Batch struct {
+	ID   string
+	Jobs []string
+}
+
+// BatchJobStatus is the status of a job of a batch
+type BatchJobStatus struct {
+	Index int
+	Param string
+	JobID string
+	Status
+}
+
+// BatchStatus is the aggregate progress of the jobs of a batch
+type BatchStatus struct {
+	// Succeeded jobs finished with exit code 0
+	Succeeded int
+	// Failed jobs finished with another exit code, were stopped, timed out or were preempted
+	Failed int
+	// Running jobs have a running process
+	Running int
+	// Pending jobs are waiting for a batch slot or queued
+	Pending int
+	// Stopped is set once the batch was stopped with StopBatch
+	Stopped bool
+	Jobs    []BatchJobStatus
+}
+
+type batch struct {
+	id          uuid.UUID
+	params      []string
+	jobs        []*job
+	parallelism int
+	// next is the index of the next job to admit
+	next    int
+	stopped bool
+}
+
+// expand returns the spec of the job of the batch for the parameter at the index
+func (s BatchSpec) expand(index int, param string) JobSpec {
+	r := strings.NewReplacer(BatchParamPlaceholder, param, BatchIndexPlaceholder, strconv.Itoa(index))
+	spec := s.Template
+	spec.Name = r.Replace(spec.Name)
+	spec.Cmd = r.Replace(spec.Cmd)
+	spec.Args = make([]string, len(s.Template.Args))
+	for i, arg := range s.Template.Args {
+		spec.Args[i] = r.Replace(arg)
+	}
+	spec.Env = make([]string, 0, len(s.Template.Env)+2)
+	for _, env := range s.Template.Env {
+		spec.Env = append(spec.Env, r.Replace(env))
+	}
+	spec.Env = append(spec.Env, "BATCH_PARAM="+param, "BATCH_INDEX="+strconv.Itoa(index))
+	return spec
+}
+
+// StartBatch creates a job for each parameter of the batch and admits them up to the parallelism of the batch.
+// The StartAt of the template is ignored.
+func (w *worker) StartBatch(spec BatchSpec) (Batch, error) {
+	if len(spec.Params) == 0 {
+		return Batch{}, errors.New("batch has no parameters")
+	}
+	if spec.Parallelism < 0 {
+		return Batch{}, errors.New("batch parallelism must not be negative")
+	}
+	spec.Template.ID = ""
+	spec.Template.StartAt = time.Time{}
+
+	w.Lock()
+	defer w.Unlock()
+	b := &batch{
+		id:          uuid.New(),
+		params:      spec.Params,
+		parallelism: spec.Parallelism,
+	}
+	for i, param := range spec.Params {
+		j, err := w.newJob(spec.expand(i, param))
+		if err != nil {
+			w.discard(b.jobs)
+			return Batch{}, err
+		}
+		j.status = Waiting
+		j.reason = "waiting for a batch slot"
+		w.jobs[j.id.String()] = j
+		b.jobs = append(b.jobs, j)
+	}
+
+	res := Batch{ID: b.id.String()}
+	for _, j := range b.jobs {
+		res.Jobs = append(res.Jobs, j.id.String())
+	}
+	w.batches[res.ID] = b
+	w.fill(b)
+	return res, nil
+}
+
+// fill admits the waiting jobs of the batch while it has free slots, the caller must hold the lock
+func (w *worker) fill(b *batch) {
+	for b.next < len(b.jobs) && (b.parallelism == 0 || b.active() < b.parallelism) {
+		j := b.jobs[b.next]
+		b.next++
+		// the job may have been stopped while waiting
+		if j.status != Waiting {
+			continue
+		}
+		w.release(j)
+		go w.awaitSlot(b, j)
+	}
+}
+
+// awaitSlot admits the next jobs of the batch once the job ended
+func (w *worker) awaitSlot(b *batch, j *job) {
+	<-j.doneChan
+	w.Lock()
+	defer w.Unlock()
+	if !b.stopped {
+		w.fill(b)
+	}
+}
+
+// active returns the number of admitted jobs of the batch which did not end yet
+func (b *batch) active() int {
+	active := 0
+	for _, j := range b.jobs[:b.next] {
+		select {
+		case <-j.doneChan:
+		default:
+			active++
+		}
+	}
+	return active
+}
+
+// StopBatch stops the jobs of the batch which did not end yet
+func (w *worker) StopBatch(batchID string) error {
+	w.Lock()
+	defer w.Unlock()
+	b, found := w.batches[batchID]
+	if !found {
+		return fmt.Errorf("batch %v not found", batchID)
+	}
+	b.stopped = true
+	for _, j := range b.jobs {
+		select {
+		case <-j.doneChan:
+			continue
+		default:
+		}
+		if err := w.terminate(j, Stopped, "batch stopped"); err != nil {
+			logrus.WithField("Job ID", j.id).Errorf("failed to stop batch job: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetBatchStatus returns the progress of the batch and the status of its jobs
+func (w *worker) GetBatchStatus(batchID string) (BatchStatus, error) {
+	w.RLock()
+	defer w.RUnlock()
+	b, found := w.batches[batchID]
+	if !found {
+		return BatchStatus{}, fmt.Errorf("batch %v not found", batchID)
+	}
+	res := BatchStatus{Stopped: b.stopped}
+	for i, j := range b.jobs {
+		res.Jobs = append(res.Jobs, BatchJobStatus{
+			Index:  i,
+			Param:  b.params[i],
+			JobID:  j.id.String(),
+			Status: w.status(j),
+		})
+		switch {
+		case j.succeeded():
+			res.Succeeded++
+		case j.failed():
+			res.Failed++
+		case j.status == Running:
+			res.Running++
+		case !j.status.Terminal():
+			res.Pending++
+		}
+	}
+	return res, nil
+}
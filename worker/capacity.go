@@ -0,0 +1,83 @@
+package worker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Admission policies of the jobs which do not fit in the available host capacity
+const (
+	// AdmissionQueue queues the jobs until enough capacity is released by running jobs
+	AdmissionQueue = "queue"
+	// AdmissionReject rejects the jobs with ErrInsufficientCapacity
+	AdmissionReject = "reject"
+)
+
+// ErrInsufficientCapacity is returned when the resource limits of a job do not fit in the host capacity
+var ErrInsufficientCapacity = errors.New("insufficient host capacity")
+
+const memInfoPath = "/proc/meminfo"
+
+// resources reserved by jobs or available on the host
+type resources struct {
+	cpuMillis   uint64
+	memoryBytes uint64
+}
+
+func (r resources) add(l Limits) resources {
+	return resources{r.cpuMillis + uint64(l.CPUMillis), r.memoryBytes + l.MemoryBytes}
+}
+
+func (r resources) sub(l Limits) resources {
+	return resources{r.cpuMillis - uint64(l.CPUMillis), r.memoryBytes - l.MemoryBytes}
+}
+
+// fits returns true when the resources are within the capacity
+func (r resources) fits(capacity resources) bool {
+	return r.cpuMillis <= capacity.cpuMillis && r.memoryBytes <= capacity.memoryBytes
+}
+
+// hostCapacity returns the CPUs usable by the process and the total memory of the host minus the headroom
+func hostCapacity(headroomCPUMillis uint64, headroomMemoryBytes uint64) (resources, error) {
+	memory, err := memTotal()
+	if err != nil {
+		return resources{}, err
+	}
+	// runtime.NumCPU accounts for the CPU affinity (cpuset) of the process
+	cpu := uint64(runtime.NumCPU()) * 1000
+	if headroomCPUMillis > cpu || headroomMemoryBytes > memory {
+		return resources{}, errors.New("headroom exceeds host capacity")
+	}
+	return resources{cpu - headroomCPUMillis, memory - headroomMemoryBytes}, nil
+}
+
+// memTotal reads the total memory of the host from /proc/meminfo
+func memTotal() (uint64, error) {
+	file, err := os.Open(memInfoPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read memory info: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// eg: "MemTotal:       16318412 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse MemTotal: %w", err)
+		}
+		return kb * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read memory info: %w", err)
+	}
+	return 0, errors.New("MemTotal not found in memory info")
+}
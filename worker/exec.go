@@ -0,0 +1,178 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// execDrainTimeout bounds the time given to read the remaining output of an exec after it was killed,
+// processes which left its process group may keep its output open
+const execDrainTimeout = time.Second
+
+// ExecSpec describes an auxiliary process run in a running job, eg: to debug it
+type ExecSpec struct {
+	Cmd  string
+	Args []string
+	// Env holds the KEY=VALUE variables added to the environment of the job
+	Env []string
+	// Stdin is written to the stdin of the process, which reads EOF after it
+	Stdin []byte
+}
+
+// Exec is an auxiliary process run in the cgroup of a job, as the user and in the environment and working directory of the job.
+// It is killed when the job attempt ends.
+type Exec struct {
+	cmd *exec.Cmd
+	// pipe is the read side of the output of the process
+	pipe *os.File
+	// output holds the combined stdout and stderr of the process
+	output   chan []byte
+	done     chan struct{} // closed when the process exited and its output was read
+	killed   chan struct{} // closed when the process is killed, its output is dropped afterwards
+	killOnce sync.Once
+	exitCode int
+}
+
+// Output returns the output of the process, the channel is closed when the process exited
+func (e *Exec) Output() <-chan []byte {
+	return e.output
+}
+
+// Wait waits for the process to exit and returns its exit code, -1 when it was killed
+func (e *Exec) Wait() int {
+	<-e.done
+	return e.exitCode
+}
+
+// kill kills the process group of the process so that its children do not outlive it in the cgroup of the job,
+// killing an exited process is a no-op. The output which was not read yet is dropped.
+func (e *Exec) kill() {
+	e.killOnce.Do(func() { close(e.killed) })
+	select {
+	case <-e.done:
+		return
+	default:
+	}
+	syscall.Kill(-e.cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// Exec starts an auxiliary process in the running attempt of the job. The process is killed when the context is done
+// or when the attempt ends, its output must be read until the channel is closed.
+func (w *worker) Exec(ctx context.Context, jobID string, spec ExecSpec) (*Exec, error) {
+	w.Lock()
+	defer w.Unlock()
+	j, found := w.jobs[jobID]
+	if !found {
+		return nil, fmt.Errorf("job %v not found", jobID)
+	}
+	if j.status != Running || j.execs == nil {
+		return nil, fmt.Errorf("job %v is not running", jobID)
+	}
+
+	cmd := w.command(j.spec, spec.Cmd, spec.Args, spec.Env)
+	// the process leads its own process group so that it is killed along with its children
+	cmd.SysProcAttr.Setpgid = true
+	// Note: the jobs are not namespaced, the process only shares the cgroup of the job.
+	cgroup, err := openCgroup(jobID)
+	if err != nil {
+		return nil, err
+	}
+	if cgroup != nil {
+		defer cgroup.Close()
+		// the process is created in the cgroup so that it never runs outside of the limits of the job
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+	}
+	if len(spec.Stdin) > 0 {
+		cmd.Stdin = bytes.NewReader(spec.Stdin)
+	}
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	err = cmd.Start()
+	// the process holds the write side of the pipe, reading returns EOF once it exited
+	pw.Close()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	e := &Exec{cmd: cmd, pipe: r, output: make(chan []byte), done: make(chan struct{}), killed: make(chan struct{})}
+	j.execs[e] = struct{}{}
+	go w.runExec(ctx, j, e)
+	return e, nil
+}
+
+// runExec forwards the output of the process until it exits
+func (w *worker) runExec(ctx context.Context, j *job, e *Exec) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			e.kill()
+		case <-stop:
+		}
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := e.pipe.Read(buf)
+		if n > 0 {
+			select {
+			case e.output <- append([]byte(nil), buf[:n]...):
+			case <-ctx.Done():
+			case <-e.killed:
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	e.pipe.Close()
+	if err := e.cmd.Wait(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Job ID": j.id,
+			"Name":   e.cmd.Path,
+			"Args":   e.cmd.Args}).Errorf("exec failed: %v", err)
+	}
+	e.exitCode = e.cmd.ProcessState.ExitCode()
+	close(e.output)
+	close(e.done)
+
+	w.Lock()
+	defer w.Unlock()
+	delete(j.execs, e)
+}
+
+// killExecs kills the auxiliary processes of the attempt which ended and waits up to execDrainTimeout for their output to be read,
+// no process can be started in the attempt anymore
+func (w *worker) killExecs(j *job) {
+	w.Lock()
+	execs := j.execs
+	j.execs = nil
+	w.Unlock()
+	for e := range execs {
+		e.kill()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), execDrainTimeout)
+	defer cancel()
+	for e := range execs {
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			// the output is not read anymore, the processes which left the process group may keep it open
+			e.pipe.Close()
+		}
+	}
+}
@@ -29,13 +29,19 @@ func (l *logger) CreateFile(JobID string) (*os.File, error) {
 	return os.Create(path)
 }
 
+// OpenFile opens the log file of the job for appending
+func (l *logger) OpenFile(JobID string) (*os.File, error) {
+	path := filepath.Join(l.logStore, fmt.Sprintf("%s.log", JobID))
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+}
+
 // RemoveFile deletes the named file under the log store.
 func (l *logger) RemoveFile(JobID string) error {
 	path := filepath.Join(l.logStore, fmt.Sprintf("%s.log", JobID))
 	return os.Remove(path)
 }
 
-// TailReader waits until new data is written to file instead of returning io.EOF
+// TailReader waits until new data is written to file instead of returning io.EOF, until doneCh is closed
 func (l *logger) TailReader(ctx context.Context, jobID string, doneCh chan struct{}) (<-chan string, error) {
 	path := filepath.Join(l.logStore, fmt.Sprintf("%s.log", jobID))
 	file, err := os.OpenFile(path, os.O_RDONLY, 0644)
@@ -79,10 +85,11 @@ func (l *logger) TailReader(ctx context.Context, jobID string, doneCh chan struc
 				logrus.Error(ctx.Err())
 				return
 			case <-doneCh:
+				// the process ended, send what is left and stop tailing
 				if err := l.sendOutputTail(ctx, outputChan, file); err != nil {
 					logrus.Errorf("failed to stream output: %v", err)
-					return
 				}
+				return
 			case event, ok := <-watcher.Events:
 				if !ok {
 					return
@@ -86,6 +86,18 @@ func addCgroupLimit(jobID string, pid int, maxCPUBandwidth *uint32, maxMemoryUsa
 	return nil
 }
 
+// openCgroup opens the cgroup directory of a running job so that processes can be started in it, nil is returned in test mode
+func openCgroup(jobID string) (*os.File, error) {
+	if testmode {
+		return nil, nil
+	}
+	f, err := os.Open(filepath.Join(cgroupPath, jobID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+	return f, nil
+}
+
 func rmdir(path string) error {
 	err := unix.Rmdir(path)
 	if err == nil || err == unix.ENOENT { // unix errors are bare
@@ -0,0 +1,207 @@
+package worker
+
+import (
+	"github.com/sirupsen/logrus"
+	"sort"
+)
+
+// scheduler queues the jobs when the maximum number of running jobs is reached or, when admission control is enabled,
+// when the resources reserved by the running jobs leave no room for the job limits in the host capacity.
+// Queued jobs are ordered by priority, then by the number of running jobs of their owner so that
+// users with fewer running jobs get served first, then in FIFO order.
+// It is not safe for concurrent use, the worker lock must be held.
+type scheduler struct {
+	maxRunning int
+	// running holds the launched jobs in launch order
+	running []*job
+	// capacity is the host capacity available to jobs, nil when admission control is disabled
+	capacity *resources
+	// reserved is the sum of the limits of the running jobs
+	reserved  resources
+	admission string
+	// runningByOwner counts the running jobs of each owner
+	runningByOwner map[string]int
+	// queue holds the queued jobs in FIFO order
+	queue []*job
+}
+
+func newScheduler(cfg Config) *scheduler {
+	s := &scheduler{
+		maxRunning:     cfg.MaxRunningJobs,
+		admission:      cfg.Admission,
+		runningByOwner: make(map[string]int),
+	}
+	if cfg.Admission != "" {
+		capacity, err := hostCapacity(cfg.HeadroomCPUMillis, cfg.HeadroomMemoryBytes)
+		if err != nil {
+			logrus.Errorf("admission control disabled, failed to read host capacity: %v", err)
+			return s
+		}
+		s.capacity = &capacity
+	}
+	return s
+}
+
+// admit returns true when the job can be launched right away, else the job is queued along with the running jobs to preempt
+// to make room for it, if any.
+// ErrInsufficientCapacity is returned when the job limits exceed the host capacity,
+// or do not fit in the capacity left by the running jobs under the reject policy and preemption cannot make room for it.
+func (s *scheduler) admit(j *job) (bool, []*job, error) {
+	if s.tooLarge(j) {
+		return false, nil, ErrInsufficientCapacity
+	}
+	if len(s.queue) == 0 && s.fits(j, nil) {
+		return true, nil, nil
+	}
+	victims := s.victims(j)
+	if victims == nil && s.admission == AdmissionReject && s.capacity != nil && !s.reserved.add(j.spec.Limits).fits(*s.capacity) {
+		return false, nil, ErrInsufficientCapacity
+	}
+	s.enqueue(j)
+	return false, victims, nil
+}
+
+// tooLarge returns true when the job limits exceed the host capacity, such a job can never be launched
+func (s *scheduler) tooLarge(j *job) bool {
+	return s.capacity != nil && !(resources{}).add(j.spec.Limits).fits(*s.capacity)
+}
+
+// enqueue adds the job to the queue
+func (s *scheduler) enqueue(j *job) {
+	s.queue = append(s.queue, j)
+}
+
+// victims returns the running preemptible jobs with a lower priority than the job to stop to make room for it,
+// or nil when the job would not be the next one launched or preempting jobs cannot make room for it.
+// The jobs with the lowest priority are preempted first, the most recently launched first among equal priorities.
+func (s *scheduler) victims(j *job) []*job {
+	for _, queued := range s.queue {
+		if s.before(queued, j) {
+			return nil
+		}
+	}
+	var candidates []*job
+	for i := len(s.running) - 1; i >= 0; i-- {
+		r := s.running[i]
+		// jobs already being stopped will free their resources anyway
+		if r.status == Running && r.spec.Preemptible && r.spec.Priority < j.spec.Priority {
+			candidates = append(candidates, r)
+		}
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		return candidates[a].spec.Priority < candidates[b].spec.Priority
+	})
+	for n := 1; n <= len(candidates); n++ {
+		if s.fits(j, candidates[:n]) {
+			return candidates[:n]
+		}
+	}
+	return nil
+}
+
+// next removes and returns the next queued job if it can be launched.
+// The jobs behind the next job wait even if they would fit so that large jobs are not starved.
+func (s *scheduler) next() *job {
+	if len(s.queue) == 0 {
+		return nil
+	}
+	best := 0
+	for i := 1; i < len(s.queue); i++ {
+		if s.before(s.queue[i], s.queue[best]) {
+			best = i
+		}
+	}
+	j := s.queue[best]
+	if !s.fits(j, nil) {
+		return nil
+	}
+	s.queue = append(s.queue[:best], s.queue[best+1:]...)
+	return j
+}
+
+// started records a launched job
+func (s *scheduler) started(j *job) {
+	s.running = append(s.running, j)
+	s.reserved = s.reserved.add(j.spec.Limits)
+	s.runningByOwner[j.spec.Owner]++
+}
+
+// finished records the end of a launched job
+func (s *scheduler) finished(j *job) {
+	for i, r := range s.running {
+		if r == j {
+			s.running = append(s.running[:i], s.running[i+1:]...)
+			break
+		}
+	}
+	s.reserved = s.reserved.sub(j.spec.Limits)
+	s.runningByOwner[j.spec.Owner]--
+	if s.runningByOwner[j.spec.Owner] <= 0 {
+		delete(s.runningByOwner, j.spec.Owner)
+	}
+}
+
+// remove drops the job from the queue
+func (s *scheduler) remove(j *job) {
+	for i, queued := range s.queue {
+		if queued == j {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// position returns the 1-based position of the job in the queue, 0 when the job is not queued
+func (s *scheduler) position(j *job) int {
+	found := false
+	position := 1
+	for _, queued := range s.queue {
+		if queued == j {
+			found = true
+			continue
+		}
+		if s.before(queued, j) {
+			position++
+		}
+	}
+	if !found {
+		return 0
+	}
+	return position
+}
+
+// before returns true when the job a is served before the job b
+func (s *scheduler) before(a, b *job) bool {
+	if a.spec.Priority != b.spec.Priority {
+		return a.spec.Priority > b.spec.Priority
+	}
+	if ra, rb := s.runningByOwner[a.spec.Owner], s.runningByOwner[b.spec.Owner]; ra != rb {
+		return ra < rb
+	}
+	return s.index(a) < s.index(b)
+}
+
+func (s *scheduler) index(j *job) int {
+	for i, queued := range s.queue {
+		if queued == j {
+			return i
+		}
+	}
+	return len(s.queue)
+}
+
+// fits returns true when a running slot is available and the job limits fit in the capacity left by the running jobs,
+// not counting the jobs to be stopped
+func (s *scheduler) fits(j *job, stopping []*job) bool {
+	if s.maxRunning != 0 && len(s.running)-len(stopping) >= s.maxRunning {
+		return false
+	}
+	if s.capacity == nil {
+		return true
+	}
+	reserved := s.reserved
+	for _, r := range stopping {
+		reserved = reserved.sub(r.spec.Limits)
+	}
+	return reserved.add(j.spec.Limits).fits(*s.capacity)
+}
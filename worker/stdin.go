@@ -0,0 +1,103 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	// ErrStdinNotOpen is returned when writing to the stdin of a job which was not started with OpenStdin
+	ErrStdinNotOpen = errors.New("job was not started with an open stdin")
+	// ErrStdinClosed is returned when writing to the stdin of a job after it was closed
+	ErrStdinClosed = errors.New("stdin of the job is closed")
+)
+
+// stdin is the stdin pipe of the process of an attempt, writes are serialized so that the data of concurrent writers is not interleaved
+type stdin struct {
+	pipe   io.WriteCloser
+	closed bool
+	// writeLock serializes the writes, it is not held along with the lock so that a blocked write does not block closing the pipe
+	writeLock sync.Mutex
+	sync.Mutex
+}
+
+// newStdin wraps the stdin pipe of a process, the payload is written first
+func newStdin(pipe io.WriteCloser, payload []byte) *stdin {
+	in := &stdin{pipe: pipe}
+	if len(payload) == 0 {
+		return in
+	}
+	in.writeLock.Lock()
+	go func() {
+		defer in.writeLock.Unlock()
+		// the process may exit before reading its whole stdin, the error is the process' concern
+		in.pipe.Write(payload)
+	}()
+	return in
+}
+
+func (in *stdin) write(data []byte) error {
+	in.writeLock.Lock()
+	defer in.writeLock.Unlock()
+	in.Lock()
+	closed := in.closed
+	in.Unlock()
+	if closed {
+		return ErrStdinClosed
+	}
+	_, err := in.pipe.Write(data)
+	if errors.Is(err, os.ErrClosed) {
+		return ErrStdinClosed
+	}
+	return err
+}
+
+// close closes the pipe, a pending write is interrupted
+func (in *stdin) close() error {
+	in.Lock()
+	defer in.Unlock()
+	if in.closed {
+		return nil
+	}
+	in.closed = true
+	return in.pipe.Close()
+}
+
+// stdinOf returns the stdin of the running attempt of the job
+func (w *worker) stdinOf(jobID string) (*stdin, error) {
+	w.RLock()
+	defer w.RUnlock()
+	j, found := w.jobs[jobID]
+	if !found {
+		return nil, fmt.Errorf("job %v not found", jobID)
+	}
+	if !j.spec.OpenStdin {
+		return nil, ErrStdinNotOpen
+	}
+	if j.status != Running || j.stdin == nil {
+		return nil, fmt.Errorf("job %v is not running", jobID)
+	}
+	return j.stdin, nil
+}
+
+// WriteStdin writes the data to the stdin of the running attempt of a job started with OpenStdin.
+// It blocks until the process reads the data or exits.
+func (w *worker) WriteStdin(jobID string, data []byte) error {
+	in, err := w.stdinOf(jobID)
+	if err != nil {
+		return err
+	}
+	return in.write(data)
+}
+
+// CloseStdin closes the stdin of the running attempt of a job started with OpenStdin, the process reads EOF
+func (w *worker) CloseStdin(jobID string) error {
+	in, err := w.stdinOf(jobID)
+	if err != nil {
+		return err
+	}
+	return in.close()
+}
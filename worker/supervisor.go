@@ -0,0 +1,123 @@
+package worker
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// Restart policies of long-running jobs
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// restartBackoffReset is the run time after which a restarted job is not considered crash looping anymore
+const restartBackoffReset = 10 * time.Minute
+
+// RestartPolicy defines when a job which ended is started again, eg: to keep a daemon running.
+type RestartPolicy struct {
+	// Policy is one of RestartNever (default), RestartOnFailure or RestartAlways
+	Policy string
+	// MaxRestarts is the maximum number of restarts, 0 is unlimited
+	MaxRestarts int
+	// InitialBackoff is the delay before restarting a crashed job, 1s when 0. The delay doubles while the job keeps crashing
+	// up to MaxBackoff, and is reset once the job ran for 10 minutes.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between restarts, 5 minutes when 0
+	MaxBackoff time.Duration
+}
+
+// restartable returns true when a job which ended with the status and exit code is restarted.
+// A timed out job is considered failed.
+func (p RestartPolicy) restartable(status StatusEnum, exitCode int) bool {
+	switch p.Policy {
+	case RestartAlways:
+		return status == Finished || status == TimedOut
+	case RestartOnFailure:
+		return (status == Finished && exitCode != 0) || status == TimedOut
+	default:
+		return false
+	}
+}
+
+// backoff returns the delay before a restart after crashLoop consecutive short runs
+func (p RestartPolicy) backoff(crashLoop int) time.Duration {
+	backoff, max := p.InitialBackoff, p.MaxBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+	for i := 0; i < crashLoop && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
+
+// Exit describes how the last attempt of a job ended
+type Exit struct {
+	Attempt  int
+	Status   StatusEnum
+	ExitCode int
+	Time     time.Time
+}
+
+// supervise decides what happens to the job once its process ended, the caller must hold the lock.
+// A preempted job is queued again when requested, a failed job is retried per its retry policy and then restarted per its restart policy.
+// The job ends otherwise.
+func (w *worker) supervise(j *job) {
+	now := time.Now()
+	j.lastExit = &Exit{
+		Attempt:  j.attempt().number,
+		Status:   j.status,
+		ExitCode: j.exitCode,
+		Time:     now,
+	}
+	switch {
+	case j.status == Preempted && j.spec.RequeueOnPreempt:
+		// the attempt goes on, the output of the next run is appended to the same log file
+		j.status = Pending
+		w.scheduler.enqueue(j)
+	case j.spec.Retry.retryable(j.status, j.exitCode) && len(j.attempts) < j.spec.Retry.MaxAttempts:
+		backoff := j.spec.Retry.backoff(len(j.attempts) + 1)
+		w.rerun(j, backoff, fmt.Sprintf("attempt %d ended with %v and exit code %d, retrying in %v", j.attempt().number, j.status, j.exitCode, backoff))
+	case j.spec.Restart.restartable(j.status, j.exitCode) && (j.spec.Restart.MaxRestarts == 0 || j.restarts < j.spec.Restart.MaxRestarts):
+		if now.Sub(j.startedAt) >= restartBackoffReset {
+			j.crashLoop = 0
+		}
+		backoff := j.spec.Restart.backoff(j.crashLoop)
+		j.crashLoop++
+		j.restarts++
+		w.rerun(j, backoff, fmt.Sprintf("attempt %d ended with %v and exit code %d, restarting in %v", j.attempt().number, j.status, j.exitCode, backoff))
+	default:
+		j.end()
+	}
+}
+
+// rerun queues a new attempt of the job after the backoff delay, the caller must hold the lock
+func (w *worker) rerun(j *job, backoff time.Duration, reason string) {
+	close(j.attempt().done)
+	if err := w.newAttempt(j); err != nil {
+		logrus.WithField("Job ID", j.id).Errorf("failed to create log of next attempt: %v", err)
+		close(j.doneChan)
+		return
+	}
+	current := j.attempt()
+	j.reason = reason
+	j.status = Pending
+	time.AfterFunc(backoff, func() {
+		w.Lock()
+		defer w.Unlock()
+		// the job may have been stopped during the backoff
+		if j.status == Pending && j.attempt() == current {
+			w.scheduler.enqueue(j)
+			w.dispatch()
+		}
+	})
+}
@@ -0,0 +1,252 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrNoTTY is returned when attaching to a job which was not started with TTY
+	ErrNoTTY = errors.New("job was not started with a tty")
+	// ErrWriterAttached is returned when attaching as the writer of a terminal which already has one
+	ErrWriterAttached = errors.New("another session is attached as the writer")
+	// ErrReadOnlySession is returned when a session which is not the writer sends input or resizes the terminal
+	ErrReadOnlySession = errors.New("session is read-only")
+	// ErrDetached is returned when using a session after it was detached
+	ErrDetached = errors.New("session is detached")
+)
+
+// Default size of the terminal of a job until it is resized
+const (
+	defaultTTYRows = 24
+	defaultTTYCols = 80
+)
+
+// ttyDrainTimeout bounds the time given to read the remaining output of the terminal after the process exited,
+// the background processes of the job may keep the terminal open
+const ttyDrainTimeout = time.Second
+
+// sessionBuffer is the number of output chunks buffered for a session, a session which falls behind is detached
+const sessionBuffer = 256
+
+// terminal is the pseudo-terminal of the process of an attempt of a job started with TTY.
+// The output is appended to the log of the attempt and sent to the attached sessions.
+type terminal struct {
+	master   *os.File
+	done     chan struct{} // closed when the output was copied
+	sessions map[*Session]struct{}
+	writer   *Session
+	// writeLock serializes the input, it is not held along with the lock so that a blocked input does not block the output
+	writeLock sync.Mutex
+	sync.Mutex
+}
+
+// Session is attached to the terminal of a job, it receives the output written after it attached.
+// Only the writer session can send input and resize the terminal.
+type Session struct {
+	term   *terminal
+	output chan []byte
+	writer bool
+}
+
+// openTTY allocates a pseudo-terminal and returns its master and slave sides
+func openTTY() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open pty: %w", err)
+	}
+	var n int
+	err = control(master, func(fd int) error {
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return err
+		}
+		if n, err = unix.IoctlGetInt(fd, unix.TIOCGPTN); err != nil {
+			return err
+		}
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &unix.Winsize{Row: defaultTTYRows, Col: defaultTTYCols})
+	})
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to set up pty: %w", err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to open pty: %w", err)
+	}
+	return master, slave, nil
+}
+
+// control runs fn on the descriptor of the file without switching it to blocking mode, so that closing the file interrupts a pending read
+func control(f *os.File, fn func(fd int) error) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	if err := rc.Control(func(fd uintptr) { fnErr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+func newTerminal(master *os.File) *terminal {
+	return &terminal{
+		master:   master,
+		done:     make(chan struct{}),
+		sessions: make(map[*Session]struct{}),
+	}
+}
+
+// copyOutput appends the output of the terminal to the log file and sends it to the sessions until the terminal is closed
+func (t *terminal) copyOutput(logfile *os.File) {
+	defer close(t.done)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.master.Read(buf)
+		if n > 0 {
+			if _, err := logfile.Write(buf[:n]); err != nil {
+				logrus.Errorf("failed to write terminal output: %v", err)
+			}
+			t.broadcast(append([]byte(nil), buf[:n]...))
+		}
+		// reading returns EIO once the process and its children closed the terminal
+		if err != nil {
+			break
+		}
+	}
+	t.Lock()
+	defer t.Unlock()
+	for s := range t.sessions {
+		t.detach(s)
+	}
+}
+
+// wait waits for the output to be copied once the process exited and closes the terminal
+func (t *terminal) wait() {
+	select {
+	case <-t.done:
+	case <-time.After(ttyDrainTimeout):
+	}
+	t.master.Close()
+	<-t.done
+}
+
+func (t *terminal) broadcast(data []byte) {
+	t.Lock()
+	defer t.Unlock()
+	for s := range t.sessions {
+		select {
+		case s.output <- data:
+		default:
+			logrus.Warn("detaching terminal session which fell behind")
+			t.detach(s)
+		}
+	}
+}
+
+func (t *terminal) attach(write bool) (*Session, error) {
+	t.Lock()
+	defer t.Unlock()
+	select {
+	case <-t.done:
+		return nil, errors.New("terminal is closed")
+	default:
+	}
+	if write && t.writer != nil {
+		return nil, ErrWriterAttached
+	}
+	s := &Session{term: t, output: make(chan []byte, sessionBuffer), writer: write}
+	t.sessions[s] = struct{}{}
+	if write {
+		t.writer = s
+	}
+	return s, nil
+}
+
+// detach removes the session, the caller must hold the lock
+func (t *terminal) detach(s *Session) {
+	if _, ok := t.sessions[s]; !ok {
+		return
+	}
+	delete(t.sessions, s)
+	close(s.output)
+	if t.writer == s {
+		t.writer = nil
+	}
+}
+
+// checkWriter verifies the session is attached as the writer
+func (t *terminal) checkWriter(s *Session) error {
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.sessions[s]; !ok {
+		return ErrDetached
+	}
+	if t.writer != s {
+		return ErrReadOnlySession
+	}
+	return nil
+}
+
+// Output returns the output of the terminal, the channel is closed when the session is detached or the job ended
+func (s *Session) Output() <-chan []byte {
+	return s.output
+}
+
+// Writer returns true when the session is attached as the writer
+func (s *Session) Writer() bool {
+	return s.writer
+}
+
+// Write sends the input to the terminal, it blocks while the terminal input buffer is full
+func (s *Session) Write(data []byte) error {
+	if err := s.term.checkWriter(s); err != nil {
+		return err
+	}
+	s.term.writeLock.Lock()
+	defer s.term.writeLock.Unlock()
+	_, err := s.term.master.Write(data)
+	return err
+}
+
+// Resize sets the window size of the terminal, the process gets SIGWINCH
+func (s *Session) Resize(rows, cols uint16) error {
+	if err := s.term.checkWriter(s); err != nil {
+		return err
+	}
+	return control(s.term.master, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &unix.Winsize{Row: rows, Col: cols})
+	})
+}
+
+// Detach detaches the session from the terminal, the job keeps running. The writer can attach again afterwards.
+func (s *Session) Detach() {
+	s.term.Lock()
+	defer s.term.Unlock()
+	s.term.detach(s)
+}
+
+// Attach attaches a session to the terminal of the running attempt of a job started with TTY.
+// Several sessions can read the output, a single one at a time is the writer sending input and resizing the terminal.
+func (w *worker) Attach(jobID string, write bool) (*Session, error) {
+	w.RLock()
+	defer w.RUnlock()
+	j, found := w.jobs[jobID]
+	if !found {
+		return nil, fmt.Errorf("job %v not found", jobID)
+	}
+	if !j.spec.TTY {
+		return nil, ErrNoTTY
+	}
+	if j.status != Running || j.terminal == nil {
+		return nil, fmt.Errorf("job %v is not running", jobID)
+	}
+	return j.terminal.attach(write)
+}
@@ -1,14 +1,19 @@
 package worker
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"io"
 	"os"
 	"os/exec"
+	"sort"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type StatusEnum int
@@ -17,32 +22,311 @@ const (
 	Running StatusEnum = iota
 	Stopped
 	Finished
+	// Pending jobs are queued until a running slot is available
+	Pending
+	// Preempted jobs were stopped to make room for a job with a higher priority
+	Preempted
+	// TimedOut jobs were stopped because they ran longer than their timeout
+	TimedOut
+	// Scheduled jobs are held until their start time
+	Scheduled
+	// Waiting jobs are workflow steps held until their dependencies ended, or batch jobs held until a batch slot is available
+	Waiting
+	// Skipped jobs are workflow steps which were not run as the conditions on their dependencies were not met
+	Skipped
 )
 
-//Worker defines the operations to manage Jobs.
+func (s StatusEnum) String() string {
+	switch s {
+	case Running:
+		return "running"
+	case Stopped:
+		return "stopped"
+	case Finished:
+		return "finished"
+	case Pending:
+		return "pending"
+	case Preempted:
+		return "preempted"
+	case TimedOut:
+		return "timed out"
+	case Scheduled:
+		return "scheduled"
+	case Waiting:
+		return "waiting"
+	case Skipped:
+		return "skipped"
+	default:
+		return fmt.Sprintf("StatusEnum(%d)", int(s))
+	}
+}
+
+// Terminal returns true when the job of the status will not run anymore
+func (s StatusEnum) Terminal() bool {
+	return s == Stopped || s == Finished || s == Preempted || s == TimedOut || s == Skipped
+}
+
+// ErrNameInUse is returned when starting a job with the name of an active job of the same owner
+var ErrNameInUse = errors.New("job name already in use")
+
+// Default resource limits of a job
+const (
+	DefaultCPUMillis   = 600
+	DefaultMemoryBytes = 50000000
+)
+
+// JobSpec describes the linux process run by a job.
+type JobSpec struct {
+	// ID is the UUID of the job, a random UUID is assigned when empty. It is set to restore a job, eg: after a restart.
+	ID   string
+	Cmd  string
+	Args []string
+	// Env holds the KEY=VALUE variables added to the environment of the process
+	Env []string
+	// InheritEnv starts the process with the environment of the worker instead of the clean environment
+	InheritEnv bool
+	// WorkingDir is the working directory of the process, the worker default is used when empty
+	WorkingDir string
+	// Credential is the account the process runs as, it runs as the user of the worker when nil
+	Credential *Credential
+	// Stdin is written to the stdin of the process of each attempt, the process reads EOF after it unless OpenStdin is set
+	Stdin []byte
+	// OpenStdin keeps the stdin of the process open after Stdin so that it can be written with WriteStdin until it is closed with CloseStdin
+	OpenStdin bool
+	// TTY runs the process in a pseudo-terminal which sessions can attach to, it excludes Stdin and OpenStdin
+	TTY    bool
+	Limits Limits
+	// Name identifies the job among the jobs of its owner, it is unique among the active jobs of the owner when set
+	Name string
+	// Labels are arbitrary key/value pairs used to select jobs
+	Labels map[string]string
+	// Owner is the user who started the job, used to share the running slots fairly between users
+	Owner string
+	// Priority orders the queued jobs, higher priorities are launched first
+	Priority int
+	// Preemptible jobs can be stopped to make room for jobs with a higher priority
+	Preemptible bool
+	// RequeueOnPreempt queues preempted jobs again instead of ending them
+	RequeueOnPreempt bool
+	// Timeout is the maximum run time of the job, the worker default timeout is used when 0
+	Timeout time.Duration
+	// Retry runs the job again when an attempt fails
+	Retry RetryPolicy
+	// Restart starts the job again when it ended, after the retries
+	Restart RestartPolicy
+	// StartAt holds the job with the Scheduled status until that time, the job is admitted right away when it is in the past
+	StartAt time.Time
+}
+
+// Credential identifies the Linux account a process runs as
+type Credential struct {
+	UID uint32
+	GID uint32
+	// Groups are the supplementary groups of the process
+	Groups []uint32
+}
+
+// RetryPolicy defines when and how often a failed job is run again, the job keeps its ID across attempts.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts including the first one, the job is not retried when lower than 2
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, 1s when 0. The delay doubles after each attempt up to MaxBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts, the delay is not capped when 0
+	MaxBackoff time.Duration
+	// RetryableExitCodes lists the exit codes which are retried, any non-zero exit code is retried when empty
+	RetryableExitCodes []int
+	// RetryOnTimeout retries the attempts stopped by the job timeout
+	RetryOnTimeout bool
+}
+
+// backoff returns the delay before the given attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for i := 2; i < attempt; i++ {
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return backoff
+}
+
+// retryable returns true when an attempt which ended with the status and exit code is retried
+func (p RetryPolicy) retryable(status StatusEnum, exitCode int) bool {
+	switch status {
+	case TimedOut:
+		return p.RetryOnTimeout
+	case Finished:
+		if exitCode == 0 {
+			return false
+		}
+		if len(p.RetryableExitCodes) == 0 {
+			return true
+		}
+		for _, code := range p.RetryableExitCodes {
+			if code == exitCode {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Limits of the resources used by a job, zero values are replaced by the default limits.
+type Limits struct {
+	// CPUMillis is the CPU bandwidth in thousandths of a CPU
+	CPUMillis   uint32
+	MemoryBytes uint64
+}
+
+// WithDefaults returns the limits with the default values set for missing limits
+func (l Limits) WithDefaults() Limits {
+	if l.CPUMillis == 0 {
+		l.CPUMillis = DefaultCPUMillis
+	}
+	if l.MemoryBytes == 0 {
+		l.MemoryBytes = DefaultMemoryBytes
+	}
+	return l
+}
+
+// Worker defines the operations to manage Jobs.
 type Worker interface {
-	Start(cmdName string, args []string) (string, error)
+	Start(spec JobSpec) (string, error)
 	Stop(jobID string) error
 	GetStatus(jobID string) (Status, error)
-	GetOutput(ctx context.Context, jobID string) (<-chan string, error)
+	GetOutput(ctx context.Context, jobID string, attempt int) (<-chan string, error)
+	WriteStdin(jobID string, data []byte) error
+	CloseStdin(jobID string) error
+	Attach(jobID string, write bool) (*Session, error)
+	Exec(ctx context.Context, jobID string, spec ExecSpec) (*Exec, error)
+	List() []JobInfo
+	StartWorkflow(steps []WorkflowStep) (Workflow, error)
+	StopWorkflow(workflowID string) error
+	GetWorkflowStatus(workflowID string) (WorkflowStatus, error)
+	StartBatch(spec BatchSpec) (Batch, error)
+	StopBatch(batchID string) error
+	GetBatchStatus(batchID string) (BatchStatus, error)
 }
 
 // job represents a Linux process scheduled by the Worker.
 type job struct {
 	id       uuid.UUID
-	cmdName  string
-	args     []string
+	spec     JobSpec
 	status   StatusEnum
+	reason   string
 	exitCode int
 	cmd      *exec.Cmd
-	doneChan chan struct{} // closed when done running
+	logfile  *os.File
+	// stdin is the stdin of the running attempt of a job started with OpenStdin
+	stdin *stdin
+	// terminal is the terminal of the running attempt of a job started with TTY
+	terminal *terminal
+	// execs holds the auxiliary processes of the running attempt, nil when no process can be started
+	execs map[*Exec]struct{}
+	// attempts holds the runs of the job, the last one is the current attempt
+	attempts  []*attempt
+	createdAt time.Time
+	startedAt time.Time
+	lastExit  *Exit
+	restarts  int
+	// crashLoop counts the consecutive restarts of a job which did not run long
+	crashLoop int
+	// startTimer admits a scheduled job at its start time
+	startTimer *time.Timer
+	// dependsOn holds the dependencies of a workflow step
+	dependsOn []dependency
+	doneChan  chan struct{} // closed when done running
+
+}
 
+// attempt is a run of the job process, each attempt has its own log file
+type attempt struct {
+	number int
+	done   chan struct{} // closed when the attempt ended
 }
 
+func (j *job) attempt() *attempt {
+	return j.attempts[len(j.attempts)-1]
+}
+
+// logName returns the name of the log file of the given attempt
+func (j *job) logName(number int) string {
+	return fmt.Sprintf("%s.%d", j.id, number)
+}
+
+// newAttempt creates the log file of the next attempt of the job
+func (w *worker) newAttempt(j *job) error {
+	number := len(j.attempts) + 1
+	logfile, err := w.log.CreateFile(j.logName(number))
+	if err != nil {
+		return err
+	}
+	if err := logfile.Close(); err != nil {
+		logrus.Errorf("failed to close log file: %v", err)
+	}
+	j.attempts = append(j.attempts, &attempt{number: number, done: make(chan struct{})})
+	return nil
+}
+
+// end closes the current attempt and the job, the caller must hold the lock
+func (j *job) end() {
+	close(j.attempt().done)
+	close(j.doneChan)
+}
+
+// Config of the worker
+type Config struct {
+	// MaxRunningJobs is the maximum number of jobs running at the same time, further jobs are queued. 0 is unlimited.
+	MaxRunningJobs int `json:"max_running_jobs"`
+	// Admission enables the admission control of jobs against the host capacity, see AdmissionQueue and AdmissionReject.
+	// It is disabled when empty.
+	Admission string `json:"admission"`
+	// HeadroomCPUMillis and HeadroomMemoryBytes are kept out of the host capacity available to jobs
+	HeadroomCPUMillis   uint64 `json:"headroom_cpu_millis"`
+	HeadroomMemoryBytes uint64 `json:"headroom_memory_bytes"`
+	// StopGracePeriodSeconds is the time given to a job to exit after SIGTERM before it is killed, 0 kills it right away
+	StopGracePeriodSeconds int `json:"stop_grace_period_seconds"`
+	// DefaultTimeoutSeconds is the maximum run time of the jobs started without timeout, 0 is unlimited
+	DefaultTimeoutSeconds int `json:"default_timeout_seconds"`
+	// BaseEnv holds the KEY=VALUE variables of the clean environment the jobs start with, on top of DefaultPath
+	BaseEnv []string `json:"base_env"`
+	// WorkingDir is the working directory of the jobs started without one, the working directory of the worker when empty
+	WorkingDir string `json:"working_dir"`
+}
+
+// Validate verifies the config, an unknown admission policy is rejected rather than handled as AdmissionQueue
+func (c Config) Validate() error {
+	switch c.Admission {
+	case "", AdmissionQueue, AdmissionReject:
+		return nil
+	default:
+		return fmt.Errorf("unknown admission policy: %q", c.Admission)
+	}
+}
+
+// DefaultPath is the PATH of the clean environment of the jobs
+const DefaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
 type worker struct {
 	// log is responsible to handle the output of a job
-	log  *logger
-	jobs map[string]*job
+	log *logger
+	// scheduler decides when the jobs are launched
+	scheduler      *scheduler
+	gracePeriod    time.Duration
+	defaultTimeout time.Duration
+	baseEnv        []string
+	workingDir     string
+	jobs           map[string]*job
+	workflows      map[string]*workflow
+	batches        map[string]*batch
 	sync.RWMutex
 }
 
@@ -50,78 +334,329 @@ type worker struct {
 type Status struct {
 	JobStatus StatusEnum
 	ExitCode  int
+	// Reason explains the status, eg: which job preempted the job
+	Reason string
+	// QueuePosition is the 1-based position of a pending job in the queue, 0 for other jobs
+	QueuePosition int
+	// Attempt is the number of the current attempt, starting at 1
+	Attempt int
+	// Restarts counts the restarts per the restart policy
+	Restarts int
+	// LastExit describes how the last attempt ended, nil when no attempt ended yet
+	LastExit *Exit
+	// StartAt is the time a scheduled job is started at, zero for jobs started right away
+	StartAt time.Time
+	// Execs is the number of auxiliary processes running in the job
+	Execs int
+}
+
+// JobInfo describes a job and its status
+type JobInfo struct {
+	ID        string
+	Spec      JobSpec
+	CreatedAt time.Time
+	Status
 }
 
 // NewWorker creates a new Worker instance.
-func NewWorker() Worker {
+func NewWorker(cfg Config) Worker {
 	return &worker{
-		jobs: make(map[string]*job),
-		log:  newLogger(),
+		jobs:           make(map[string]*job),
+		workflows:      make(map[string]*workflow),
+		batches:        make(map[string]*batch),
+		log:            newLogger(),
+		scheduler:      newScheduler(cfg),
+		gracePeriod:    time.Duration(cfg.StopGracePeriodSeconds) * time.Second,
+		defaultTimeout: time.Duration(cfg.DefaultTimeoutSeconds) * time.Second,
+		baseEnv:        append([]string{DefaultPath}, cfg.BaseEnv...),
+		workingDir:     cfg.WorkingDir,
 	}
 }
 
 // Starts a linux process and assigns a uuid to the underlying process.
-// A log file with the JobID name is created to capture the output of the running process
-func (w *worker) Start(cmdName string, args []string) (string, error) {
-	jobID := uuid.New()
-	fileName := jobID.String()
-	logfile, err := w.log.CreateFile(fileName)
+// A log file with the JobID name is created to capture the output of the running process.
+// When the maximum number of running jobs is reached the job is queued and launched once a running job ends.
+// When admission control is enabled, ErrInsufficientCapacity is returned for jobs whose limits do not fit in the host capacity.
+// A job which cannot be launched right away preempts the running preemptible jobs with a lower priority if that makes room for it.
+// A job with a start time in the future is held as Scheduled and admitted at that time.
+func (w *worker) Start(spec JobSpec) (string, error) {
+	w.Lock()
+	defer w.Unlock()
+	job, err := w.newJob(spec)
 	if err != nil {
 		return "", err
 	}
-	cmd := exec.Command(cmdName, args...)
+	jobID := job.id.String()
+	if delay := time.Until(spec.StartAt); delay > 0 {
+		job.status = Scheduled
+		job.reason = fmt.Sprintf("scheduled to start at %v", spec.StartAt.Format(time.RFC3339))
+		job.startTimer = time.AfterFunc(delay, func() {
+			w.Lock()
+			defer w.Unlock()
+			// the job may have been stopped meanwhile
+			if job.status == Scheduled {
+				w.release(job)
+			}
+		})
+		w.jobs[jobID] = job
+		return jobID, nil
+	}
+	if err := w.admit(job); err != nil {
+		if err := w.log.RemoveFile(job.logName(1)); err != nil {
+			logrus.Errorf("Unable to remove file, err: %v", err)
+		}
+		return jobID, err
+	}
+	w.jobs[jobID] = job
+	return jobID, nil
+}
+
+// newJob creates the job of the spec and the log file of its first attempt, the caller must hold the lock
+func (w *worker) newJob(spec JobSpec) (*job, error) {
+	jobID := uuid.New()
+	if spec.ID != "" {
+		id, err := uuid.Parse(spec.ID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid job ID: %w", err)
+		}
+		jobID = id
+	}
+	spec.Limits = spec.Limits.WithDefaults()
+	if spec.Timeout == 0 {
+		spec.Timeout = w.defaultTimeout
+	}
+	job := &job{
+		id:        jobID,
+		spec:      spec,
+		status:    Pending,
+		createdAt: time.Now(),
+		doneChan:  make(chan struct{}),
+	}
+	if _, found := w.jobs[jobID.String()]; found {
+		return nil, fmt.Errorf("job %v already exists", jobID)
+	}
+	if spec.Name != "" {
+		for _, other := range w.jobs {
+			if other.spec.Owner == spec.Owner && other.spec.Name == spec.Name && !other.status.Terminal() {
+				return nil, fmt.Errorf("%w: %s", ErrNameInUse, spec.Name)
+			}
+		}
+	}
+	if w.scheduler.tooLarge(job) {
+		return nil, ErrInsufficientCapacity
+	}
+	if err := w.newAttempt(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// discard removes jobs created by newJob which were not started, the caller must hold the lock
+func (w *worker) discard(jobs []*job) {
+	for _, j := range jobs {
+		delete(w.jobs, j.id.String())
+		if err := w.log.RemoveFile(j.logName(1)); err != nil {
+			logrus.Errorf("Unable to remove file, err: %v", err)
+		}
+	}
+}
+
+// release admits a held job once it can start, the job ends when it cannot be admitted anymore. The caller must hold the lock.
+func (w *worker) release(j *job) {
+	j.status = Pending
+	j.reason = ""
+	if err := w.admit(j); err != nil {
+		logrus.WithField("Job ID", j.id).Errorf("failed to start held job: %v", err)
+		j.status = Finished
+		j.reason = err.Error()
+		j.exitCode = -1
+		j.end()
+	}
+}
+
+// admit launches the job, or queues it and preempts the jobs making room for it, the caller must hold the lock
+func (w *worker) admit(j *job) error {
+	admitted, victims, err := w.scheduler.admit(j)
+	if err != nil {
+		return err
+	}
+	if !admitted {
+		for _, victim := range victims {
+			if err := w.terminate(victim, Preempted, fmt.Sprintf("preempted by job %v", j.id)); err != nil {
+				logrus.WithField("Job ID", victim.id).Errorf("failed to preempt job: %v", err)
+			}
+		}
+		return nil
+	}
+	return w.launch(j)
+}
+
+// launch starts the process of the job within its cgroup, the caller must hold the lock
+func (w *worker) launch(j *job) error {
+	logfile, err := w.log.OpenFile(j.logName(j.attempt().number))
+	if err != nil {
+		return err
+	}
+	cmd := w.command(j.spec, j.spec.Cmd, j.spec.Args, nil)
 	cmd.Stdout = logfile
 	cmd.Stderr = logfile
+	var stdinPipe io.WriteCloser
+	var master *os.File
+	if j.spec.TTY {
+		var slave *os.File
+		if master, slave, err = openTTY(); err != nil {
+			logfile.Close()
+			return err
+		}
+		// the parent side of the terminal is closed once the process started, the process reads EIO once it exits
+		defer slave.Close()
+		if c := j.spec.Credential; c != nil {
+			if err := slave.Chown(int(c.UID), int(c.GID)); err != nil {
+				logrus.Errorf("failed to change the owner of the job terminal: %v", err)
+			}
+		}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+		// the process leads a new session with the terminal as its controlling terminal, its stdin
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setctty = true
+	} else if j.spec.OpenStdin {
+		if stdinPipe, err = cmd.StdinPipe(); err != nil {
+			logfile.Close()
+			return err
+		}
+	} else if len(j.spec.Stdin) > 0 {
+		cmd.Stdin = bytes.NewReader(j.spec.Stdin)
+	}
 
 	if err := cmd.Start(); err != nil {
-		if err := w.log.RemoveFile(fileName); err != nil {
-			logrus.Errorf("Unable to remove file, err: %v", err)
+		if master != nil {
+			master.Close()
 		}
-		return jobID.String(), err
+		logfile.Close()
+		return err
 	}
 	pid := cmd.Process.Pid
-	// Note: Ideally, the CPU, memory and disk IO config would be passed in as part of the StartJob request for each job. These should be included in the proto.
-	// For this exercise, I have decided to cut scope and set a default value for these limits if none are passed in.
-	if err := addCgroupLimit(jobID.String(), pid, nil, nil, nil, nil, nil, nil, nil, nil); err != nil {
+	// cpu.max quota is given in microseconds for the default period of 100ms
+	cpuQuota := j.spec.Limits.CPUMillis * 100
+	// Note: the disk IO limits are not part of the StartJob request yet, the default limits are used.
+	if err := addCgroupLimit(j.id.String(), pid, &cpuQuota, &j.spec.Limits.MemoryBytes, nil, nil, nil, nil, nil, nil); err != nil {
 		logrus.Errorf("error adding cgroup limits for job: %v", err)
-		return jobID.String(), err
+		// the process must not run outside of its limits
+		if err := cmd.Process.Kill(); err == nil {
+			cmd.Wait()
+		}
+		if master != nil {
+			master.Close()
+		}
+		logfile.Close()
+		return err
 	}
 
-	job := &job{
-		id:       jobID,
-		cmdName:  cmdName,
-		args:     args,
-		cmd:      cmd,
-		status:   Running,
-		doneChan: make(chan struct{}),
+	j.cmd = cmd
+	j.logfile = logfile
+	if stdinPipe != nil {
+		j.stdin = newStdin(stdinPipe, j.spec.Stdin)
+	}
+	j.execs = make(map[*Exec]struct{})
+	j.terminal = nil
+	if master != nil {
+		j.terminal = newTerminal(master)
+		go j.terminal.copyOutput(logfile)
 	}
+	j.status = Running
+	j.reason = ""
+	j.startedAt = time.Now()
+	w.scheduler.started(j)
+	go w.run(j)
+	return nil
+}
 
-	w.Lock()
-	w.jobs[jobID.String()] = job
-	w.Unlock()
-	go w.run(job)
-	return jobID.String(), nil
+// command returns the command running a process with the environment, working directory and credential of the job spec,
+// env is added to the environment of the job
+func (w *worker) command(spec JobSpec, name string, args []string, env []string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	// the jobs do not see the environment of the worker unless asked, later variables override the earlier ones
+	base := w.baseEnv
+	if spec.InheritEnv {
+		base = os.Environ()
+	}
+	cmd.Env = make([]string, 0, len(base)+len(spec.Env)+len(env))
+	cmd.Env = append(append(append(cmd.Env, base...), spec.Env...), env...)
+	cmd.Dir = w.workingDir
+	if spec.WorkingDir != "" {
+		cmd.Dir = spec.WorkingDir
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	if c := spec.Credential; c != nil {
+		// the supplementary groups of the worker are dropped when the job has none
+		groups := append(make([]uint32, 0, len(c.Groups)), c.Groups...)
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: c.UID, Gid: c.GID, Groups: groups}
+	}
+	return cmd
+}
+
+// dispatch launches the queued jobs while running slots are available, the caller must hold the lock
+func (w *worker) dispatch() {
+	for {
+		j := w.scheduler.next()
+		if j == nil {
+			return
+		}
+		if err := w.launch(j); err != nil {
+			logrus.WithField("Job ID", j.id).Errorf("failed to launch queued job: %v", err)
+			j.status = Finished
+			j.exitCode = -1
+			j.end()
+		}
+	}
 }
 
 func (w *worker) run(j *job) {
-	defer close(j.doneChan)
-	defer RemovePath(j.id.String())
+	cmd := j.cmd
+	term := j.terminal
+	if j.spec.Timeout > 0 {
+		timer := time.AfterFunc(j.spec.Timeout, func() {
+			w.Lock()
+			defer w.Unlock()
+			// the job may have been stopped or launched again meanwhile
+			if j.cmd == cmd && j.status == Running {
+				if err := w.terminate(j, TimedOut, fmt.Sprintf("exceeded timeout of %v", j.spec.Timeout)); err != nil {
+					logrus.WithField("Job ID", j.id).Errorf("failed to stop timed out job: %v", err)
+				}
+			}
+		})
+		defer timer.Stop()
+	}
 	//Wait for the cmd to be finished or killed
-	if err := j.cmd.Wait(); err != nil {
+	if err := cmd.Wait(); err != nil {
 		logrus.WithFields(logrus.Fields{
 			"Job ID": j.id,
-			"Name":   j.cmdName,
-			"Args":   j.args}).Errorf("execution failed: %v", err)
+			"Name":   j.spec.Cmd,
+			"Args":   j.spec.Args}).Errorf("execution failed: %v", err)
 	}
+	if term != nil {
+		term.wait()
+	}
+	w.killExecs(j)
+	if err := j.logfile.Close(); err != nil {
+		logrus.Errorf("failed to close log file: %v", err)
+	}
+	if err := RemovePath(j.id.String()); err != nil {
+		logrus.Errorf("failed to remove cgroup: %v", err)
+	}
+
 	w.Lock()
+	defer w.Unlock()
 	j.exitCode = j.cmd.ProcessState.ExitCode()
-	if j.status != Stopped {
+	w.scheduler.finished(j)
+	if j.status == Running {
 		j.status = Finished
 	}
-	w.Unlock()
+	w.supervise(j)
+	w.dispatch()
 }
 
-// Stops the underlying linux job with the given JobID
+// Stops the underlying linux job with the given JobID, a queued job is removed from the queue
 func (w *worker) Stop(jobID string) error {
 	w.Lock()
 	defer w.Unlock()
@@ -134,15 +669,49 @@ func (w *worker) Stop(jobID string) error {
 	case <-job.doneChan:
 		return nil
 	default:
-		// NOTE: This potentially is in race condition with Wait call in the run goroutine started by Start,
-		// so we check for ErrProcessDone even though we acquired the lock.
-		switch err := job.cmd.Process.Signal(syscall.SIGKILL); err {
-		case os.ErrProcessDone:
-			return nil
-		default:
-			job.status = Stopped
-			return err
+		return w.terminate(job, Stopped, "")
+	}
+}
+
+// terminate ends the job with the given status, the caller must hold the lock.
+// A queued job is removed from the queue and a scheduled or waiting job is not started. A running job is sent SIGTERM and killed after the grace period,
+// or killed right away when there is no grace period.
+func (w *worker) terminate(j *job, status StatusEnum, reason string) error {
+	if j.status == Pending || j.status == Scheduled || j.status == Waiting {
+		if j.startTimer != nil {
+			j.startTimer.Stop()
 		}
+		w.scheduler.remove(j)
+		j.status = status
+		j.reason = reason
+		j.exitCode = -1
+		j.end()
+		return nil
+	}
+	sig := syscall.SIGKILL
+	if w.gracePeriod > 0 {
+		sig = syscall.SIGTERM
+	}
+	// NOTE: This potentially is in race condition with Wait call in the run goroutine started by Start,
+	// so we check for ErrProcessDone even though we acquired the lock.
+	switch err := j.cmd.Process.Signal(sig); err {
+	case os.ErrProcessDone:
+		return nil
+	case nil:
+		j.status = status
+		j.reason = reason
+		if sig == syscall.SIGTERM {
+			process := j.cmd.Process
+			time.AfterFunc(w.gracePeriod, func() {
+				// killing an already waited process returns ErrProcessDone
+				process.Kill()
+			})
+		}
+		return nil
+	default:
+		j.status = status
+		j.reason = reason
+		return err
 	}
 }
 
@@ -154,20 +723,57 @@ func (w *worker) GetStatus(jobID string) (Status, error) {
 	if !found {
 		return Status{}, fmt.Errorf("job %v not found", jobID)
 	}
-	// return a copy of status to avoid data races
-	stat, exitCode := job.status, job.exitCode
+	return w.status(job), nil
+}
 
-	return Status{stat, exitCode}, nil
+// status returns a copy of the status of the job to avoid data races, the caller must hold the lock
+func (w *worker) status(j *job) Status {
+	return Status{
+		JobStatus:     j.status,
+		ExitCode:      j.exitCode,
+		Reason:        j.reason,
+		QueuePosition: w.scheduler.position(j),
+		Attempt:       len(j.attempts),
+		Restarts:      j.restarts,
+		LastExit:      j.lastExit,
+		StartAt:       j.spec.StartAt,
+		Execs:         len(j.execs),
+	}
 }
 
-// GetOutput reads from the log file. If the context is canceled the channel will
+// GetOutput reads from the log file of the given attempt, the current attempt when 0.
+// The channel is closed once the attempt ended and its output was sent. If the context is canceled the channel will
 // be closed and the tailing will be stopped.
-func (w *worker) GetOutput(ctx context.Context, jobID string) (<-chan string, error) {
+func (w *worker) GetOutput(ctx context.Context, jobID string, attempt int) (<-chan string, error) {
 	w.RLock()
 	job, found := w.jobs[jobID]
-	w.RUnlock()
 	if !found {
+		w.RUnlock()
 		return nil, fmt.Errorf("job %v not found", jobID)
 	}
-	return w.log.TailReader(ctx, job.id.String(), job.doneChan)
+	if attempt < 0 || attempt > len(job.attempts) {
+		w.RUnlock()
+		return nil, fmt.Errorf("job %v has no attempt %d", jobID, attempt)
+	}
+	if attempt == 0 {
+		attempt = len(job.attempts)
+	}
+	done := job.attempts[attempt-1].done
+	name := job.logName(attempt)
+	w.RUnlock()
+	return w.log.TailReader(ctx, name, done)
+}
+
+// List returns the jobs known by the worker in the order they were created
+func (w *worker) List() []JobInfo {
+	w.RLock()
+	defer w.RUnlock()
+	jobs := make([]JobInfo, 0, len(w.jobs))
+	for id, j := range w.jobs {
+		jobs = append(jobs, JobInfo{ID: id, Spec: j.spec, CreatedAt: j.createdAt, Status: w.status(j)})
+	}
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].CreatedAt.Before(jobs[k].CreatedAt)
+	})
+	return jobs
 }
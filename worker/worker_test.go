@@ -2,8 +2,12 @@ package worker
 
 import (
 	"context"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -13,22 +17,22 @@ func init() {
 }
 
 func TestWorker_Start(t *testing.T) {
-	w := NewWorker()
-	jobID, err := w.Start("echo", []string{"foo"})
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{Cmd: "echo", Args: []string{"foo"}})
 	assert.Nil(t, err)
 	assert.NotEmpty(t, jobID)
 }
 
 func TestWorker_StartNonExistingCommand(t *testing.T) {
-	w := NewWorker()
-	jobID, err := w.Start("xyz", []string{"foo"})
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{Cmd: "xyz", Args: []string{"foo"}})
 	assert.NotEmpty(t, jobID)
 	assert.NotNil(t, err)
 }
 
 func TestWorker_Stop(t *testing.T) {
-	w := NewWorker()
-	jobID, err := w.Start("sleep", []string{"4"})
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"4"}})
 	assert.Nil(t, err)
 	err = w.Stop(jobID)
 	assert.Nil(t, err)
@@ -36,14 +40,14 @@ func TestWorker_Stop(t *testing.T) {
 
 func TestWorker_StopNonExistingJob(t *testing.T) {
 	randomJobID, _ := uuid.NewRandom()
-	w := NewWorker()
+	w := NewWorker(Config{})
 	err := w.Stop(randomJobID.String())
 	assert.NotNil(t, err)
 }
 
 func TestWorker_GetStatus(t *testing.T) {
-	w := NewWorker()
-	jobID, err := w.Start("sleep", []string{"1"})
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"1"}})
 	assert.NotEmpty(t, jobID)
 	assert.NoError(t, err)
 
@@ -60,12 +64,12 @@ func TestWorker_GetStatus(t *testing.T) {
 }
 
 func TestWorker_StreamExistingProcess(t *testing.T) {
-	w := NewWorker()
-	jobID, err := w.Start("bash", []string{"-c", "while true; do date; sleep 1; done"})
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{Cmd: "bash", Args: []string{"-c", "while true; do date; sleep 1; done"}})
 	assert.Nil(t, err)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	logchan, err := w.GetOutput(ctx, jobID)
+	logchan, err := w.GetOutput(ctx, jobID, 0)
 	assert.Nil(t, err)
 
 	assert.NotNil(t, <-logchan)
@@ -76,9 +80,668 @@ func TestWorker_StreamExistingProcess(t *testing.T) {
 }
 
 func TestWorker_StreamNonExistingProcess(t *testing.T) {
-	w := NewWorker()
+	w := NewWorker(Config{})
 	randomJobID, _ := uuid.NewRandom()
-	logchan, err := w.GetOutput(context.Background(), randomJobID.String())
+	logchan, err := w.GetOutput(context.Background(), randomJobID.String(), 0)
 	assert.Error(t, err)
 	assert.Nil(t, logchan)
 }
+
+func TestWorker_QueueWhenMaxRunning(t *testing.T) {
+	w := NewWorker(Config{MaxRunningJobs: 1})
+	first, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"1"}})
+	assert.NoError(t, err)
+	second, err := w.Start(JobSpec{Cmd: "echo", Args: []string{"foo"}})
+	assert.NoError(t, err)
+	third, err := w.Start(JobSpec{Cmd: "echo", Args: []string{"bar"}})
+	assert.NoError(t, err)
+
+	stat, err := w.GetStatus(third)
+	assert.NoError(t, err)
+	assert.Equal(t, Pending, stat.JobStatus)
+	assert.Equal(t, 2, stat.QueuePosition)
+
+	err = w.Stop(second)
+	assert.NoError(t, err)
+	stat, err = w.GetStatus(second)
+	assert.NoError(t, err)
+	assert.Equal(t, Stopped, stat.JobStatus)
+
+	stat, err = w.GetStatus(third)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stat.QueuePosition)
+
+	assert.NoError(t, w.Stop(first))
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetStatus(third)
+		return err == nil && stat.JobStatus == Finished
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestWorker_QueuePriorityAndFairShare(t *testing.T) {
+	w := NewWorker(Config{MaxRunningJobs: 1})
+	running, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"1"}, Owner: "alice"})
+	assert.NoError(t, err)
+	aliceJob, err := w.Start(JobSpec{Cmd: "echo", Owner: "alice"})
+	assert.NoError(t, err)
+	bobJob, err := w.Start(JobSpec{Cmd: "echo", Owner: "bob"})
+	assert.NoError(t, err)
+	urgentJob, err := w.Start(JobSpec{Cmd: "echo", Owner: "alice", Priority: 10})
+	assert.NoError(t, err)
+
+	positions := map[string]int{}
+	for _, jobID := range []string{urgentJob, bobJob, aliceJob} {
+		stat, err := w.GetStatus(jobID)
+		assert.NoError(t, err)
+		positions[jobID] = stat.QueuePosition
+	}
+	assert.Equal(t, 1, positions[urgentJob])
+	// bob has no running job so bob is served before alice
+	assert.Equal(t, 2, positions[bobJob])
+	assert.Equal(t, 3, positions[aliceJob])
+
+	for _, jobID := range []string{running, urgentJob, bobJob, aliceJob} {
+		assert.NoError(t, w.Stop(jobID))
+	}
+}
+
+func TestWorker_AdmissionControl(t *testing.T) {
+	w := NewWorker(Config{}).(*worker)
+	w.scheduler.capacity = &resources{cpuMillis: 1000, memoryBytes: 100}
+
+	_, err := w.Start(JobSpec{Cmd: "echo", Limits: Limits{CPUMillis: 500, MemoryBytes: 200}})
+	assert.ErrorIs(t, err, ErrInsufficientCapacity)
+
+	first, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"1"}, Limits: Limits{CPUMillis: 500, MemoryBytes: 60}})
+	assert.NoError(t, err)
+	second, err := w.Start(JobSpec{Cmd: "echo", Limits: Limits{CPUMillis: 500, MemoryBytes: 60}})
+	assert.NoError(t, err)
+	stat, err := w.GetStatus(second)
+	assert.NoError(t, err)
+	assert.Equal(t, Pending, stat.JobStatus)
+
+	w.scheduler.admission = AdmissionReject
+	_, err = w.Start(JobSpec{Cmd: "echo", Limits: Limits{CPUMillis: 500, MemoryBytes: 60}})
+	assert.ErrorIs(t, err, ErrInsufficientCapacity)
+
+	assert.NoError(t, w.Stop(first))
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetStatus(second)
+		return err == nil && stat.JobStatus == Finished
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	for _, admission := range []string{"", AdmissionQueue, AdmissionReject} {
+		assert.NoError(t, Config{Admission: admission}.Validate(), admission)
+	}
+	assert.Error(t, Config{Admission: "rejct"}.Validate())
+}
+
+func TestWorker_Preemption(t *testing.T) {
+	w := NewWorker(Config{MaxRunningJobs: 1})
+	victim, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"5"}, Preemptible: true, RequeueOnPreempt: true})
+	assert.NoError(t, err)
+	urgent, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"1"}, Priority: 5})
+	assert.NoError(t, err)
+
+	stat, err := w.GetStatus(victim)
+	assert.NoError(t, err)
+	assert.Equal(t, Preempted, stat.JobStatus)
+	assert.Contains(t, stat.Reason, urgent)
+
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetStatus(urgent)
+		return err == nil && stat.JobStatus == Running
+	}, 2*time.Second, 10*time.Millisecond)
+	stat, err = w.GetStatus(victim)
+	assert.NoError(t, err)
+	assert.Equal(t, Pending, stat.JobStatus)
+
+	assert.NoError(t, w.Stop(urgent))
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetStatus(victim)
+		return err == nil && stat.JobStatus == Running
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NoError(t, w.Stop(victim))
+}
+
+func TestWorker_NoPreemptionOfHigherPriority(t *testing.T) {
+	w := NewWorker(Config{MaxRunningJobs: 1})
+	running, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"5"}, Preemptible: true, Priority: 5})
+	assert.NoError(t, err)
+	queued, err := w.Start(JobSpec{Cmd: "echo", Priority: 1})
+	assert.NoError(t, err)
+
+	stat, err := w.GetStatus(running)
+	assert.NoError(t, err)
+	assert.Equal(t, Running, stat.JobStatus)
+	stat, err = w.GetStatus(queued)
+	assert.NoError(t, err)
+	assert.Equal(t, Pending, stat.JobStatus)
+
+	assert.NoError(t, w.Stop(queued))
+	assert.NoError(t, w.Stop(running))
+}
+
+func TestWorker_Timeout(t *testing.T) {
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"5"}, Timeout: 100 * time.Millisecond})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetStatus(jobID)
+		return err == nil && stat.JobStatus == TimedOut
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestWorker_DefaultTimeout(t *testing.T) {
+	w := NewWorker(Config{DefaultTimeoutSeconds: 1})
+	jobID, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"5"}})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetStatus(jobID)
+		return err == nil && stat.JobStatus == TimedOut
+	}, 3*time.Second, 10*time.Millisecond)
+	stat, err := w.GetStatus(jobID)
+	assert.NoError(t, err)
+	assert.Equal(t, "exceeded timeout of 1s", stat.Reason)
+}
+
+func TestWorker_Retry(t *testing.T) {
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{
+		Cmd:  "bash",
+		Args: []string{"-c", "echo attempt; exit 3"},
+		Retry: RetryPolicy{
+			MaxAttempts:        3,
+			InitialBackoff:     10 * time.Millisecond,
+			RetryableExitCodes: []int{3},
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetStatus(jobID)
+		return err == nil && stat.JobStatus == Finished
+	}, 2*time.Second, 10*time.Millisecond)
+	stat, err := w.GetStatus(jobID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stat.Attempt)
+	assert.Equal(t, 3, stat.ExitCode)
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		logchan, err := w.GetOutput(context.Background(), jobID, attempt)
+		assert.NoError(t, err)
+		var output string
+		for log := range logchan {
+			output += log
+		}
+		assert.Equal(t, "attempt\n", output)
+	}
+	_, err = w.GetOutput(context.Background(), jobID, 4)
+	assert.Error(t, err)
+}
+
+func TestWorker_NoRetryOnSuccess(t *testing.T) {
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{Cmd: "echo", Args: []string{"foo"}, Retry: RetryPolicy{MaxAttempts: 3}})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetStatus(jobID)
+		return err == nil && stat.JobStatus == Finished && stat.Attempt == 1
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(t, time.Second, p.backoff(2))
+	assert.Equal(t, 2*time.Second, p.backoff(3))
+	assert.Equal(t, 4*time.Second, p.backoff(4))
+	assert.Equal(t, 5*time.Second, p.backoff(5))
+}
+
+func TestWorker_RestartAlways(t *testing.T) {
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{
+		Cmd:     "echo",
+		Args:    []string{"foo"},
+		Restart: RestartPolicy{Policy: RestartAlways, MaxRestarts: 2, InitialBackoff: 10 * time.Millisecond},
+	})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetStatus(jobID)
+		return err == nil && stat.JobStatus == Finished
+	}, 2*time.Second, 10*time.Millisecond)
+	stat, err := w.GetStatus(jobID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stat.Restarts)
+	assert.Equal(t, 3, stat.Attempt)
+	assert.NotNil(t, stat.LastExit)
+	assert.Equal(t, 3, stat.LastExit.Attempt)
+	assert.Equal(t, 0, stat.LastExit.ExitCode)
+}
+
+func TestWorker_RestartOnFailureStopped(t *testing.T) {
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{
+		Cmd:     "bash",
+		Args:    []string{"-c", "exit 1"},
+		Restart: RestartPolicy{Policy: RestartOnFailure, InitialBackoff: time.Minute},
+	})
+	assert.NoError(t, err)
+
+	// the job waits for its restart after the first crash
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetStatus(jobID)
+		return err == nil && stat.Restarts == 1 && stat.JobStatus == Pending
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NoError(t, w.Stop(jobID))
+	stat, err := w.GetStatus(jobID)
+	assert.NoError(t, err)
+	assert.Equal(t, Stopped, stat.JobStatus)
+	assert.Equal(t, 1, stat.LastExit.ExitCode)
+}
+
+func TestRestartPolicy_Backoff(t *testing.T) {
+	p := RestartPolicy{InitialBackoff: time.Second, MaxBackoff: 3 * time.Second}
+	assert.Equal(t, time.Second, p.backoff(0))
+	assert.Equal(t, 2*time.Second, p.backoff(1))
+	assert.Equal(t, 3*time.Second, p.backoff(2))
+}
+
+func TestWorker_StartAt(t *testing.T) {
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{Cmd: "echo", Args: []string{"foo"}, StartAt: time.Now().Add(200 * time.Millisecond)})
+	assert.NoError(t, err)
+	stat, err := w.GetStatus(jobID)
+	assert.NoError(t, err)
+	assert.Equal(t, Scheduled, stat.JobStatus)
+
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetStatus(jobID)
+		return err == nil && stat.JobStatus == Finished && stat.ExitCode == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestWorker_StopScheduled(t *testing.T) {
+	w := NewWorker(Config{})
+	jobID := uuid.New().String()
+	_, err := w.Start(JobSpec{ID: jobID, Cmd: "echo", Args: []string{"foo"}, StartAt: time.Now().Add(100 * time.Millisecond)})
+	assert.NoError(t, err)
+	_, err = w.Start(JobSpec{ID: jobID, Cmd: "echo"})
+	assert.Error(t, err)
+
+	assert.NoError(t, w.Stop(jobID))
+	time.Sleep(200 * time.Millisecond)
+	stat, err := w.GetStatus(jobID)
+	assert.NoError(t, err)
+	assert.Equal(t, Stopped, stat.JobStatus)
+}
+
+func TestWorker_Workflow(t *testing.T) {
+	w := NewWorker(Config{})
+	wf, err := w.StartWorkflow([]WorkflowStep{
+		{Name: "package", Spec: JobSpec{Cmd: "echo", Args: []string{"package"}}, DependsOn: []Dependency{{Step: "test"}}},
+		{Name: "build", Spec: JobSpec{Cmd: "echo", Args: []string{"build"}}},
+		{Name: "test", Spec: JobSpec{Cmd: "false"}, DependsOn: []Dependency{{Step: "build"}}},
+		{Name: "report", Spec: JobSpec{Cmd: "echo", Args: []string{"report"}}, DependsOn: []Dependency{{Step: "test", Condition: ConditionFailure}}},
+		{Name: "cleanup", Spec: JobSpec{Cmd: "echo"}, DependsOn: []Dependency{{Step: "package", Condition: ConditionAlways}}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(wf.Jobs))
+
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetWorkflowStatus(wf.ID)
+		return err == nil && stat.Status != WorkflowRunning
+	}, 2*time.Second, 10*time.Millisecond)
+	stat, err := w.GetWorkflowStatus(wf.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, WorkflowFailed, stat.Status)
+	statuses := make(map[string]StatusEnum)
+	for _, step := range stat.Steps {
+		statuses[step.Name] = step.JobStatus
+	}
+	assert.Equal(t, map[string]StatusEnum{
+		"package": Skipped,
+		"build":   Finished,
+		"test":    Finished,
+		"report":  Finished,
+		"cleanup": Finished,
+	}, statuses)
+}
+
+func TestWorker_StopWorkflow(t *testing.T) {
+	w := NewWorker(Config{})
+	wf, err := w.StartWorkflow([]WorkflowStep{
+		{Name: "first", Spec: JobSpec{Cmd: "sleep", Args: []string{"5"}}},
+		{Name: "second", Spec: JobSpec{Cmd: "echo"}, DependsOn: []Dependency{{Step: "first", Condition: ConditionAlways}}},
+	})
+	assert.NoError(t, err)
+	stat, err := w.GetStatus(wf.Jobs["second"])
+	assert.NoError(t, err)
+	assert.Equal(t, Waiting, stat.JobStatus)
+
+	assert.NoError(t, w.StopWorkflow(wf.ID))
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetWorkflowStatus(wf.ID)
+		return err == nil && stat.Status == WorkflowStopped
+	}, 2*time.Second, 10*time.Millisecond)
+	stat, err = w.GetStatus(wf.Jobs["second"])
+	assert.NoError(t, err)
+	assert.Equal(t, Stopped, stat.JobStatus)
+}
+
+func TestWorker_WorkflowValidation(t *testing.T) {
+	w := NewWorker(Config{})
+	_, err := w.StartWorkflow([]WorkflowStep{
+		{Name: "a", Spec: JobSpec{Cmd: "echo"}, DependsOn: []Dependency{{Step: "b"}}},
+		{Name: "b", Spec: JobSpec{Cmd: "echo"}, DependsOn: []Dependency{{Step: "a"}}},
+	})
+	assert.Error(t, err)
+	_, err = w.StartWorkflow([]WorkflowStep{
+		{Name: "a", Spec: JobSpec{Cmd: "echo"}, DependsOn: []Dependency{{Step: "missing"}}},
+	})
+	assert.Error(t, err)
+}
+
+func TestWorker_Batch(t *testing.T) {
+	w := NewWorker(Config{})
+	b, err := w.StartBatch(BatchSpec{
+		Template: JobSpec{
+			Cmd:  "bash",
+			Args: []string{"-c", "sleep 0.2; echo $INPUT; exit $BATCH_INDEX", "{{index}}"},
+			Env:  []string{"INPUT=file-{{param}}.txt"},
+		},
+		Params:      []string{"a", "b", "c"},
+		Parallelism: 2,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(b.Jobs))
+
+	stat, err := w.GetBatchStatus(b.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stat.Running)
+	assert.Equal(t, 1, stat.Pending)
+	assert.Equal(t, Waiting, stat.Jobs[2].JobStatus)
+
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetBatchStatus(b.ID)
+		return err == nil && stat.Succeeded == 1 && stat.Failed == 2
+	}, 3*time.Second, 10*time.Millisecond)
+
+	logchan, err := w.GetOutput(context.Background(), b.Jobs[1], 0)
+	assert.NoError(t, err)
+	var output string
+	for line := range logchan {
+		output += line
+	}
+	assert.Equal(t, "file-b.txt\n", output)
+}
+
+func TestWorker_StopBatch(t *testing.T) {
+	w := NewWorker(Config{})
+	b, err := w.StartBatch(BatchSpec{
+		Template:    JobSpec{Cmd: "sleep", Args: []string{"5"}},
+		Params:      []string{"1", "2", "3"},
+		Parallelism: 1,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, w.StopBatch(b.ID))
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetBatchStatus(b.ID)
+		return err == nil && stat.Stopped && stat.Failed == 3
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestWorker_UniqueName(t *testing.T) {
+	w := NewWorker(Config{})
+	first, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"5"}, Name: "build", Owner: "alice", Labels: map[string]string{"team": "ci"}})
+	assert.NoError(t, err)
+	_, err = w.Start(JobSpec{Cmd: "echo", Name: "build", Owner: "alice"})
+	assert.ErrorIs(t, err, ErrNameInUse)
+	_, err = w.Start(JobSpec{Cmd: "echo", Name: "build", Owner: "bob"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, w.Stop(first))
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetStatus(first)
+		return err == nil && stat.JobStatus.Terminal()
+	}, 2*time.Second, 10*time.Millisecond)
+	_, err = w.Start(JobSpec{Cmd: "echo", Name: "build", Owner: "alice"})
+	assert.NoError(t, err)
+
+	jobs := w.List()
+	assert.Equal(t, 3, len(jobs))
+	assert.Equal(t, first, jobs[0].ID)
+	assert.Equal(t, "ci", jobs[0].Spec.Labels["team"])
+}
+
+func TestWorker_CleanEnvironment(t *testing.T) {
+	t.Setenv("WORKER_SECRET", "secret")
+	t.Setenv("LANG", "")
+	w := NewWorker(Config{BaseEnv: []string{"LANG=C"}, WorkingDir: "/"})
+	output := func(spec JobSpec) string {
+		jobID, err := w.Start(spec)
+		assert.NoError(t, err)
+		logchan, err := w.GetOutput(context.Background(), jobID, 0)
+		assert.NoError(t, err)
+		var output string
+		for line := range logchan {
+			output += line
+		}
+		return output
+	}
+	script := []string{"-c", "echo $LANG:$WORKER_SECRET:$FOO:$(pwd)"}
+	assert.Equal(t, "C::bar:/\n", output(JobSpec{Cmd: "bash", Args: script, Env: []string{"FOO=bar"}}))
+	assert.Equal(t, ":secret::/tmp\n", output(JobSpec{Cmd: "bash", Args: script, InheritEnv: true, WorkingDir: "/tmp"}))
+}
+
+func TestWorker_Credential(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching the user of a job requires root")
+	}
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{Cmd: "id", Args: []string{"-u"}, Credential: &Credential{UID: 65534, GID: 65534}})
+	assert.NoError(t, err)
+	logchan, err := w.GetOutput(context.Background(), jobID, 0)
+	assert.NoError(t, err)
+	var output string
+	for line := range logchan {
+		output += line
+	}
+	assert.Equal(t, "65534\n", output)
+}
+
+func TestWorker_Stdin(t *testing.T) {
+	w := NewWorker(Config{})
+	output := func(jobID string) string {
+		logchan, err := w.GetOutput(context.Background(), jobID, 0)
+		assert.NoError(t, err)
+		var output string
+		for line := range logchan {
+			output += line
+		}
+		return output
+	}
+
+	jobID, err := w.Start(JobSpec{Cmd: "cat", Stdin: []byte("payload\n")})
+	assert.NoError(t, err)
+	assert.Equal(t, "payload\n", output(jobID))
+	assert.ErrorIs(t, w.WriteStdin(jobID, []byte("more\n")), ErrStdinNotOpen)
+
+	jobID, err = w.Start(JobSpec{Cmd: "cat", Stdin: []byte("payload\n"), OpenStdin: true})
+	assert.NoError(t, err)
+	assert.NoError(t, w.WriteStdin(jobID, []byte("more\n")))
+	assert.NoError(t, w.CloseStdin(jobID))
+	assert.Error(t, w.WriteStdin(jobID, []byte("again\n")))
+	assert.Equal(t, "payload\nmore\n", output(jobID))
+}
+
+func TestWorker_Attach(t *testing.T) {
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{Cmd: "bash", Args: []string{"-c", "read line; stty size; echo got $line; sleep 5"}, TTY: true})
+	assert.NoError(t, err)
+	// readUntil reads the output of the session until it contains s
+	readUntil := func(session *Session, s string) bool {
+		var output string
+		timeout := time.After(3 * time.Second)
+		for {
+			select {
+			case data, ok := <-session.Output():
+				if !ok {
+					return false
+				}
+				output += string(data)
+				if strings.Contains(output, s) {
+					return true
+				}
+			case <-timeout:
+				return false
+			}
+		}
+	}
+
+	writer, err := w.Attach(jobID, true)
+	assert.NoError(t, err)
+	assert.True(t, writer.Writer())
+	_, err = w.Attach(jobID, true)
+	assert.ErrorIs(t, err, ErrWriterAttached)
+	reader, err := w.Attach(jobID, false)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, reader.Write([]byte("x")), ErrReadOnlySession)
+
+	assert.NoError(t, writer.Resize(40, 100))
+	assert.NoError(t, writer.Write([]byte("hello\n")))
+	assert.True(t, readUntil(reader, "40 100"))
+	assert.True(t, readUntil(reader, "got hello"))
+
+	writer.Detach()
+	assert.ErrorIs(t, writer.Write([]byte("x")), ErrDetached)
+	stat, err := w.GetStatus(jobID)
+	assert.NoError(t, err)
+	assert.Equal(t, Running, stat.JobStatus)
+	writer, err = w.Attach(jobID, true)
+	assert.NoError(t, err)
+
+	assert.NoError(t, w.Stop(jobID))
+	assert.Eventually(t, func() bool {
+		_, ok := <-writer.Output()
+		return !ok
+	}, 3*time.Second, 10*time.Millisecond)
+	_, err = w.Attach(jobID, false)
+	assert.Error(t, err)
+
+	jobID, err = w.Start(JobSpec{Cmd: "true"})
+	assert.NoError(t, err)
+	_, err = w.Attach(jobID, false)
+	assert.ErrorIs(t, err, ErrNoTTY)
+}
+
+func TestWorker_Exec(t *testing.T) {
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"5"}, Env: []string{"JOB=1"}})
+	assert.NoError(t, err)
+
+	e, err := w.Exec(context.Background(), jobID, ExecSpec{Cmd: "bash", Args: []string{"-c", "cat; echo $JOB; exit 3"}, Stdin: []byte("in\n")})
+	assert.NoError(t, err)
+	var output string
+	for data := range e.Output() {
+		output += string(data)
+	}
+	assert.Equal(t, "in\n1\n", output)
+	assert.Equal(t, 3, e.Wait())
+
+	// the process is killed when the job ends
+	e, err = w.Exec(context.Background(), jobID, ExecSpec{Cmd: "sleep", Args: []string{"5"}})
+	assert.NoError(t, err)
+	stat, err := w.GetStatus(jobID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stat.Execs)
+	assert.NoError(t, w.Stop(jobID))
+	for range e.Output() {
+	}
+	assert.Equal(t, -1, e.Wait())
+	_, err = w.Exec(context.Background(), jobID, ExecSpec{Cmd: "true"})
+	assert.Error(t, err)
+
+	// the process is killed when the context is done
+	jobID, err = w.Start(JobSpec{Cmd: "sleep", Args: []string{"5"}})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	e, err = w.Exec(ctx, jobID, ExecSpec{Cmd: "sleep", Args: []string{"5"}})
+	assert.NoError(t, err)
+	cancel()
+	assert.Equal(t, -1, e.Wait())
+	assert.NoError(t, w.Stop(jobID))
+}
+
+func TestWorker_ExecKillsChildren(t *testing.T) {
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"5"}})
+	assert.NoError(t, err)
+	// the background child keeps the output open after bash exited
+	e, err := w.Exec(context.Background(), jobID, ExecSpec{Cmd: "bash", Args: []string{"-c", "sleep 5 & echo $!"}})
+	assert.NoError(t, err)
+	output := string(<-e.Output())
+	pid, err := strconv.Atoi(strings.TrimSpace(output))
+	assert.NoError(t, err)
+
+	assert.NoError(t, w.Stop(jobID))
+	for range e.Output() {
+	}
+	e.Wait()
+	assert.Eventually(t, func() bool {
+		// the child may be left as a zombie when no process reaps it
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		return err != nil || strings.Contains(string(stat), ") Z ")
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestWorker_StdinNotRead(t *testing.T) {
+	w := NewWorker(Config{})
+	// the payload does not fit in the pipe buffer of a process which never reads it
+	payload := make([]byte, 1<<20)
+	jobID, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"5"}, Stdin: payload, OpenStdin: true})
+	assert.NoError(t, err)
+
+	written := make(chan error)
+	go func() {
+		written <- w.WriteStdin(jobID, []byte("more\n"))
+	}()
+	closed := make(chan error)
+	go func() {
+		closed <- w.CloseStdin(jobID)
+	}()
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("CloseStdin blocked on the pending payload")
+	}
+	select {
+	case err := <-written:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("WriteStdin blocked after stdin was closed")
+	}
+	assert.NoError(t, w.Stop(jobID))
+}
+
+func TestWorker_ExecOutputNotRead(t *testing.T) {
+	w := NewWorker(Config{})
+	jobID, err := w.Start(JobSpec{Cmd: "sleep", Args: []string{"1"}})
+	assert.NoError(t, err)
+	// the output of the process is never read
+	e, err := w.Exec(context.Background(), jobID, ExecSpec{Cmd: "bash", Args: []string{"-c", "echo out; sleep 5"}})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		stat, err := w.GetStatus(jobID)
+		return err == nil && stat.JobStatus == Finished
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, -1, e.Wait())
+}
@@ -0,0 +1,314 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrInvalidWorkflow is returned for workflows with invalid steps or dependencies
+var ErrInvalidWorkflow = errors.New("invalid workflow")
+
+// Conditions on the dependencies of a workflow step
+const (
+	// ConditionSuccess is met when the dependency finished with exit code 0
+	ConditionSuccess = "success"
+	// ConditionFailure is met when the dependency failed, was stopped, timed out or was preempted
+	ConditionFailure = "failure"
+	// ConditionAlways is met once the dependency ended, whatever its status
+	ConditionAlways = "always"
+)
+
+// WorkflowStatusEnum is the aggregate status of the steps of a workflow
+type WorkflowStatusEnum int
+
+const (
+	// WorkflowRunning workflows have steps which did not end yet
+	WorkflowRunning WorkflowStatusEnum = iota
+	// WorkflowSucceeded workflows ended without failed steps, skipped steps do not fail a workflow
+	WorkflowSucceeded
+	// WorkflowFailed workflows ended with at least one failed, stopped, timed out or preempted step
+	WorkflowFailed
+	// WorkflowStopped workflows were stopped with StopWorkflow
+	WorkflowStopped
+)
+
+func (s WorkflowStatusEnum) String() string {
+	switch s {
+	case WorkflowRunning:
+		return "running"
+	case WorkflowSucceeded:
+		return "succeeded"
+	case WorkflowFailed:
+		return "failed"
+	case WorkflowStopped:
+		return "stopped"
+	default:
+		return fmt.Sprintf("WorkflowStatusEnum(%d)", int(s))
+	}
+}
+
+// Dependency of a workflow step on another step of the same workflow
+type Dependency struct {
+	Step string
+	// Condition on how the step ended, ConditionSuccess when empty
+	Condition string
+}
+
+// WorkflowStep is a job of a workflow. A step with dependencies is Waiting until all of them ended,
+// it is then started when all their conditions are met and Skipped otherwise. The StartAt of the spec is ignored.
+type WorkflowStep struct {
+	Name      string
+	Spec      JobSpec
+	DependsOn []Dependency
+}
+
+// Workflow identifies a started workflow and the jobs of its steps
+type Workflow struct {
+	ID string
+	// Jobs maps the step names to their job ID
+	Jobs map[string]string
+}
+
+// StepStatus is the status of the job of a workflow step
+type StepStatus struct {
+	Name  string
+	JobID string
+	Status
+}
+
+// WorkflowStatus of a workflow and of its steps in the order they were submitted
+type WorkflowStatus struct {
+	Status WorkflowStatusEnum
+	Steps  []StepStatus
+}
+
+type workflow struct {
+	id    uuid.UUID
+	names []string
+	steps map[string]*job
+	// stopped is set by StopWorkflow
+	stopped bool
+}
+
+// dependency of a waiting job on the job of another step
+type dependency struct {
+	step      string
+	job       *job
+	condition string
+}
+
+func (d dependency) met() bool {
+	switch d.condition {
+	case ConditionAlways:
+		return true
+	case ConditionFailure:
+		return d.job.failed()
+	default:
+		return d.job.succeeded()
+	}
+}
+
+func (j *job) succeeded() bool {
+	return j.status == Finished && j.exitCode == 0
+}
+
+func (j *job) failed() bool {
+	switch j.status {
+	case Stopped, TimedOut, Preempted:
+		return true
+	case Finished:
+		return j.exitCode != 0
+	default:
+		return false
+	}
+}
+
+// sortSteps validates the steps of a workflow and returns them in an order where each step comes after its dependencies
+func sortSteps(steps []WorkflowStep) ([]WorkflowStep, error) {
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%w: no steps", ErrInvalidWorkflow)
+	}
+	index := make(map[string]int)
+	for i, step := range steps {
+		if step.Name == "" {
+			return nil, fmt.Errorf("%w: step without name", ErrInvalidWorkflow)
+		}
+		if _, ok := index[step.Name]; ok {
+			return nil, fmt.Errorf("%w: duplicate step %s", ErrInvalidWorkflow, step.Name)
+		}
+		index[step.Name] = i
+	}
+	dependents := make(map[string][]string)
+	pending := make([]int, len(steps))
+	for i, step := range steps {
+		for _, dep := range step.DependsOn {
+			if _, ok := index[dep.Step]; !ok {
+				return nil, fmt.Errorf("%w: step %s depends on unknown step %s", ErrInvalidWorkflow, step.Name, dep.Step)
+			}
+			switch dep.Condition {
+			case "", ConditionSuccess, ConditionFailure, ConditionAlways:
+			default:
+				return nil, fmt.Errorf("%w: step %s has unknown condition %s", ErrInvalidWorkflow, step.Name, dep.Condition)
+			}
+			dependents[dep.Step] = append(dependents[dep.Step], step.Name)
+			pending[i]++
+		}
+	}
+	var ordered []WorkflowStep
+	for i, step := range steps {
+		if pending[i] == 0 {
+			ordered = append(ordered, step)
+		}
+	}
+	for i := 0; i < len(ordered); i++ {
+		for _, name := range dependents[ordered[i].Name] {
+			pending[index[name]]--
+			if pending[index[name]] == 0 {
+				ordered = append(ordered, steps[index[name]])
+			}
+		}
+	}
+	if len(ordered) != len(steps) {
+		return nil, fmt.Errorf("%w: dependency cycle", ErrInvalidWorkflow)
+	}
+	return ordered, nil
+}
+
+// StartWorkflow creates the jobs of the steps, the steps without dependencies are started right away.
+// ErrInvalidWorkflow is returned when a step has no name, depends on an unknown step or when the dependencies have a cycle.
+func (w *worker) StartWorkflow(steps []WorkflowStep) (Workflow, error) {
+	ordered, err := sortSteps(steps)
+	if err != nil {
+		return Workflow{}, err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	wf := &workflow{
+		id:    uuid.New(),
+		steps: make(map[string]*job),
+	}
+	for _, step := range ordered {
+		j, err := w.newJob(step.Spec)
+		if err != nil {
+			var created []*job
+			for _, c := range wf.steps {
+				created = append(created, c)
+			}
+			w.discard(created)
+			return Workflow{}, fmt.Errorf("step %s: %w", step.Name, err)
+		}
+		w.jobs[j.id.String()] = j
+		for _, dep := range step.DependsOn {
+			j.dependsOn = append(j.dependsOn, dependency{step: dep.Step, job: wf.steps[dep.Step], condition: dep.Condition})
+		}
+		wf.steps[step.Name] = j
+	}
+
+	res := Workflow{ID: wf.id.String(), Jobs: make(map[string]string)}
+	for _, step := range steps {
+		j := wf.steps[step.Name]
+		wf.names = append(wf.names, step.Name)
+		res.Jobs[step.Name] = j.id.String()
+	}
+	w.workflows[res.ID] = wf
+	for _, step := range ordered {
+		j := wf.steps[step.Name]
+		if len(j.dependsOn) == 0 {
+			w.release(j)
+			continue
+		}
+		j.status = Waiting
+		j.reason = "waiting for dependencies"
+		go w.await(j)
+	}
+	return res, nil
+}
+
+// await starts the waiting job once its dependencies ended, the job is skipped when the condition on a dependency is not met
+func (w *worker) await(j *job) {
+	for _, dep := range j.dependsOn {
+		select {
+		case <-dep.job.doneChan:
+		case <-j.doneChan:
+			// the job was stopped
+			return
+		}
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if j.status != Waiting {
+		return
+	}
+	for _, dep := range j.dependsOn {
+		if !dep.met() {
+			condition := dep.condition
+			if condition == "" {
+				condition = ConditionSuccess
+			}
+			j.status = Skipped
+			j.reason = fmt.Sprintf("step %s ended with %v and exit code %d, condition %s not met", dep.step, dep.job.status, dep.job.exitCode, condition)
+			j.exitCode = -1
+			j.end()
+			return
+		}
+	}
+	w.release(j)
+}
+
+// StopWorkflow stops the steps of the workflow which did not end yet
+func (w *worker) StopWorkflow(workflowID string) error {
+	w.Lock()
+	defer w.Unlock()
+	wf, found := w.workflows[workflowID]
+	if !found {
+		return fmt.Errorf("workflow %v not found", workflowID)
+	}
+	wf.stopped = true
+	for _, name := range wf.names {
+		j := wf.steps[name]
+		select {
+		case <-j.doneChan:
+			continue
+		default:
+		}
+		if err := w.terminate(j, Stopped, "workflow stopped"); err != nil {
+			logrus.WithField("Job ID", j.id).Errorf("failed to stop workflow step: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetWorkflowStatus returns the aggregate status of the workflow and the status of its steps
+func (w *worker) GetWorkflowStatus(workflowID string) (WorkflowStatus, error) {
+	w.RLock()
+	defer w.RUnlock()
+	wf, found := w.workflows[workflowID]
+	if !found {
+		return WorkflowStatus{}, fmt.Errorf("workflow %v not found", workflowID)
+	}
+	res := WorkflowStatus{Status: WorkflowSucceeded}
+	running, failed := false, false
+	for _, name := range wf.names {
+		j := wf.steps[name]
+		res.Steps = append(res.Steps, StepStatus{
+			Name:   name,
+			JobID:  j.id.String(),
+			Status: w.status(j),
+		})
+		running = running || !j.status.Terminal()
+		failed = failed || j.failed()
+	}
+	switch {
+	case running:
+		res.Status = WorkflowRunning
+	case wf.stopped:
+		res.Status = WorkflowStopped
+	case failed:
+		res.Status = WorkflowFailed
+	}
+	return res, nil
+}